@@ -21,6 +21,8 @@ var (
 	srcRepo   *Repo
 	dstRepo   *Repo
 	imgList   []string
+	rawList   []string
+	lister    *ImageLister
 	flConfSrc *string
 	flConfDst *string
 	flConfLst *string
@@ -28,6 +30,14 @@ var (
 	flConfImg *string
 	flConfOut *string
 	flConfWat *bool
+	flConfPlt *string
+	flConfRat *float64
+	flConfPln *bool
+	flConfPlo *string
+	flConfPrn *bool
+	flConfKep *int
+	flConfIcl *string
+	flConfExl *string
 )
 
 func main() {
@@ -40,6 +50,12 @@ func main() {
 		loggerCfg, _ = ioutil.ReadFile(filepath.Join(HOME, "logCfg.xml"))
 	}
 	InitLogger(loggerCfg)
+
+	if len(os.Args) > 1 && os.Args[1] == "encrypt" {
+		encrypt(os.Args[2:])
+		return
+	}
+
 	CONF = new(YamlCfg)
 
 	var cfgFile []byte
@@ -71,10 +87,26 @@ func main() {
 		os.Exit(1)
 	}
 
+	err = CONF.DecryptSecrets()
+	if err != nil {
+		fmt.Print(I18n.Sprintf("Decrypt secrets in cfg.yaml failed: %v", err))
+		os.Exit(1)
+	}
+
+	err = CheckProxies(CONF)
+	if err != nil {
+		fmt.Print(I18n.Sprintf("Check the proxies in cfg.yaml failed: %v", err))
+		os.Exit(1)
+	}
+
 	if CONF.MaxConn == 0 {
 		CONF.MaxConn = runtime.NumCPU()
 	}
 
+	if CONF.MaxStreams == 0 {
+		CONF.MaxStreams = CONF.MaxConn
+	}
+
 	if CONF.Retries == 0 {
 		CONF.Retries = 2
 	}
@@ -83,6 +115,10 @@ func main() {
 		INTERVAL = CONF.Interval
 	}
 
+	if CONF.BlobRetries > 0 {
+		BLOB_RETRIES = CONF.BlobRetries
+	}
+
 	if len(CONF.Compressor) == 0 {
 		if runtime.GOOS == "windows" {
 			CONF.Compressor = "tar"
@@ -112,6 +148,11 @@ func main() {
 		InitI18nPrinter(CONF.Lang)
 	}
 
+	if len(os.Args) > 1 && (os.Args[1] == "doctor" || os.Args[1] == "ping") {
+		doctor(os.Args[2:])
+		return
+	}
+
 	flConfSrc = flag.String("src", "", I18n.Sprintf("Source repository name, default: the first repo in cfg.yaml"))
 	flConfDst = flag.String("dst", "", I18n.Sprintf("Destination repository name, default: the first repo in cfg.yaml"))
 	flConfLst = flag.String("lst", "", I18n.Sprintf("Image list file, one image each line"))
@@ -119,6 +160,14 @@ func main() {
 	flConfImg = flag.String("img", "", I18n.Sprintf("Image meta file to upload(*meta.yaml)"))
 	flConfOut = flag.String("out", "", I18n.Sprintf("Output filename prefix"))
 	flConfWat = flag.Bool("watch", false, I18n.Sprintf("Watch mode"))
+	flConfPlt = flag.String("platform", "", I18n.Sprintf("Platforms of multi-arch images to keep, ex: linux/amd64,linux/arm64, default: all"))
+	flConfRat = flag.Float64("ratelimit", 0, I18n.Sprintf("Global rate limit in MB/s, default: the ratelimit in cfg.yaml"))
+	flConfPln = flag.Bool("plan", false, I18n.Sprintf("Plan mode, estimate the data to transfer without writing anything"))
+	flConfPlo = flag.String("planout", "", I18n.Sprintf("The json file of the plan, default: plan_<time>.json"))
+	flConfPrn = flag.Bool("prune", false, I18n.Sprintf("Mirror mode, prune the destination tags no longer present in the source after transmitting, preview only with -plan"))
+	flConfKep = flag.Int("keep", 0, I18n.Sprintf("Keep the newest N tags by version in the mirror mode instead, default: the prune.keep in cfg.yaml"))
+	flConfIcl = flag.String("include", "", I18n.Sprintf("Keep the images(namespace/repository:tag) matching the regular expression, added to the filter.include in cfg.yaml"))
+	flConfExl = flag.String("exclude", "", I18n.Sprintf("Drop the images(namespace/repository:tag) matching the regular expression, added to the filter.exclude in cfg.yaml"))
 
 	flag.Usage = func() {
 		fmt.Println(I18n.Sprintf("Image Transmit-Ghang'e-WhaleCloud DevOps Team"))
@@ -129,6 +178,11 @@ func main() {
 		fmt.Print(I18n.Sprintf("            Transmit mode:       %s -src=nj -lst=img.lst -dst=gz\n", os.Args[0]))
 		fmt.Print(I18n.Sprintf("            Watch mode:          %s -src=nj -lst=img.lst -dst=gz --watch\n", os.Args[0]))
 		fmt.Print(I18n.Sprintf("            Upload mode:         %s -dst=gz -img=img_full_202106122344_meta.yaml [-lst=img.lst]\n", os.Args[0]))
+		fmt.Print(I18n.Sprintf("            Plan mode:           %s -src=nj -lst=img.lst [-dst=gz] [-inc=...] -plan [-planout=plan.json]\n", os.Args[0]))
+		fmt.Print(I18n.Sprintf("            Mirror mode:         %s -src=nj -lst=img.lst -dst=gz [--watch] -prune [-keep=10] [-plan]\n", os.Args[0]))
+		fmt.Print(I18n.Sprintf("            Project mode:        echo 'project/*' | %s -src=nj -dst=gz [-include=...] [-exclude=...]\n", os.Args[0]))
+		fmt.Print(I18n.Sprintf("            Encrypt mode:        %s encrypt [-cfg=cfg.yaml] [-value=password]\n", os.Args[0]))
+		fmt.Print(I18n.Sprintf("            Doctor mode:         %s doctor [-repo=gz] [-scratch=library/test]\n", os.Args[0]))
 		fmt.Print(I18n.Sprintf("More description please refer to github.com/wct-devops/image-transmit\n"))
 		flag.PrintDefaults()
 	}
@@ -170,6 +224,31 @@ func main() {
 		CONF.OutPrefix = *flConfOut
 	}
 
+	if len(*flConfPlt) > 0 {
+		CONF.Platforms = strings.Split(*flConfPlt, ",")
+	}
+
+	if *flConfRat > 0 {
+		CONF.RateLimit = *flConfRat
+	}
+
+	if *flConfKep > 0 {
+		CONF.Prune.Keep = *flConfKep
+	}
+
+	if len(*flConfIcl) > 0 {
+		CONF.Filter.Include = append(CONF.Filter.Include, *flConfIcl)
+	}
+
+	if len(*flConfExl) > 0 {
+		CONF.Filter.Exclude = append(CONF.Filter.Exclude, *flConfExl)
+	}
+
+	if err := SetupRateLimit(CONF); err != nil {
+		fmt.Println(I18n.Sprintf("Setup the rate limit failed: %v", err))
+		os.Exit(1)
+	}
+
 	var lc *LocalCache
 	if CONF.Cache.Pathname != "" {
 		keepDays := 7
@@ -197,32 +276,133 @@ func main() {
 		if err != nil {
 			os.Exit(1)
 		}
-		if *flConfWat {
+		// the watch mode expands the list in each round
+		if !*flConfWat || *flConfPln {
+			if err := expandImgList(ctx, false); err != nil {
+				os.Exit(1)
+			}
+		}
+		if *flConfPln {
+			planTransmit(ctx)
+			if *flConfPrn {
+				pruneRepos(ctx)
+			}
+		} else if *flConfWat {
 			BeginAction(ctx)
 			watch(ctx)
 		} else {
 			BeginAction(ctx)
 			transmit(ctx)
+			if *flConfPrn {
+				pruneRepos(ctx)
+			}
 			EndAction(ctx)
 		}
 	} else if len(*flConfImg) > 0 && len(*flConfDst) > 0 {
-		BeginAction(ctx)
-		upload(ctx)
-		EndAction(ctx)
+		if *flConfPln {
+			planUpload(ctx)
+		} else {
+			BeginAction(ctx)
+			upload(ctx)
+			EndAction(ctx)
+		}
 	} else if len(*flConfSrc) > 0 {
 		err := readImgList(ctx)
 		if err != nil {
 			os.Exit(1)
 		}
-		BeginAction(ctx)
-		download(ctx)
-		EndAction(ctx)
+		if err := expandImgList(ctx, false); err != nil {
+			os.Exit(1)
+		}
+		if *flConfPln {
+			planDownload(ctx)
+		} else {
+			BeginAction(ctx)
+			download(ctx)
+			EndAction(ctx)
+		}
 	} else {
 		fmt.Println(I18n.Sprintf("Invalid args, please refer the help"))
 		flag.Usage()
 	}
 }
 
+// encrypt prints the encrypted value, or encrypts the plain secrets of the cfg.yaml in place
+func encrypt(args []string) {
+	fs := flag.NewFlagSet("encrypt", flag.ExitOnError)
+	flCfg := fs.String("cfg", "", I18n.Sprintf("The cfg.yaml to encrypt in place, default: cfg.yaml or data/cfg.yaml"))
+	flValue := fs.String("value", "", I18n.Sprintf("The value to encrypt"))
+	fs.Parse(args)
+
+	_, err := os.Stat(SecretKeyFile())
+	newKey := os.Getenv(SECRET_KEY_ENV) == "" && os.IsNotExist(err)
+
+	if len(*flValue) > 0 {
+		encrypted, err := EncryptSecret(*flValue)
+		if err != nil {
+			fmt.Println(I18n.Sprintf("Encrypt failed: %v", err))
+			os.Exit(1)
+		}
+		fmt.Println(encrypted)
+	} else {
+		filename := *flCfg
+		if len(filename) == 0 {
+			filename = "cfg.yaml"
+			if _, err := os.Stat(filename); os.IsNotExist(err) {
+				filename = filepath.Join(HOME, "cfg.yaml")
+			}
+		}
+		n, err := EncryptConfigFile(filename)
+		if err != nil {
+			fmt.Println(I18n.Sprintf("Encrypt failed: %v", err))
+			os.Exit(1)
+		}
+		fmt.Println(I18n.Sprintf("Encrypted %v secrets in %s", n, filename))
+	}
+
+	if newKey {
+		fmt.Println(I18n.Sprintf("Generated a new secret key file %s, keep it safe or set the key by env %s", SecretKeyFile(), SECRET_KEY_ENV))
+	}
+	if os.Getenv(SECRET_KEY_ENV) == "" && KeyFileInDataDir(SecretKeyFile()) {
+		fmt.Println(I18n.Sprintf("WARNING: the secret key file %s is in the data dir %s, anyone copying the data dir can decrypt the secrets, move it to %s or set the key by env %s", SecretKeyFile(), HOME, SECRET_KEY_FILE, SECRET_KEY_ENV))
+	}
+}
+
+// doctor diagnoses the repos in cfg.yaml and prints a pass/fail table, exits with 1 if any check fails
+func doctor(args []string) {
+	fs := flag.NewFlagSet("doctor", flag.ExitOnError)
+	flRepo := fs.String("repo", "", I18n.Sprintf("The repo name to diagnose, default: all the repos in cfg.yaml"))
+	flScratch := fs.String("scratch", DOCTOR_SCRATCH, I18n.Sprintf("The scratch repository to test the permissions, nothing is written"))
+	fs.Parse(args)
+	DOCTOR_SCRATCH = *flScratch
+
+	ctx := NewTaskContext(NewCmdLogger(), nil, nil)
+	ctx.Reset()
+	d := NewDoctor(ctx)
+	found := false
+	for _, repos := range []struct {
+		repos  []Repo
+		target bool
+	}{{CONF.SrcRepos, false}, {CONF.DstRepos, true}} {
+		for i := range repos.repos {
+			repo := &repos.repos[i]
+			if repo.Registry == "" || (len(*flRepo) > 0 && repo.Name != *flRepo) {
+				continue
+			}
+			found = true
+			d.Diagnose(repo, repos.target)
+		}
+	}
+	if !found {
+		fmt.Print(I18n.Sprintf("Could not find repo: %s", *flRepo))
+		os.Exit(1)
+	}
+	d.Print()
+	if d.Failed() > 0 {
+		os.Exit(1)
+	}
+}
+
 func readImgList(ctx *TaskContext) error {
 	if len(*flConfLst) > 0 {
 		b, err := ioutil.ReadFile(*flConfLst)
@@ -252,6 +432,41 @@ func readImgList(ctx *TaskContext) error {
 	return nil
 }
 
+// expandImgList expands the wildcard entries of the image list by the source registry, the original list is kept
+// for the watch mode to expand it again in each round, with the repositories only as the watch mode lists the tags
+func expandImgList(ctx *TaskContext, repoOnly bool) error {
+	if lister == nil {
+		var err error
+		lister, err = NewImageLister(ctx, srcRepo, CONF.Filter)
+		if err != nil {
+			return ctx.Errorf(I18n.Sprintf("Setup the image filter failed: %v", err))
+		}
+		rawList = imgList
+	}
+
+	wildcard := false
+	for _, rawURL := range rawList {
+		if IsWildcard(rawURL) {
+			wildcard = true
+			break
+		}
+	}
+	if !wildcard {
+		return nil
+	}
+
+	list, err := lister.Expand(srcRepo.Registry, rawList, repoOnly)
+	if err != nil {
+		return ctx.Errorf("%v", err)
+	}
+	if len(list) < 1 {
+		return ctx.Errorf(I18n.Sprintf("Empty image list"))
+	}
+	imgList = list
+	ctx.Info(I18n.Sprintf("Get %v images", len(imgList)))
+	return nil
+}
+
 func getInputList(input string) {
 	input = strings.ReplaceAll(input, "\t", "")
 	if CheckInvalidChar(strings.ReplaceAll(strings.ReplaceAll(input, "\r", ""), "\n", "")) {
@@ -288,7 +503,7 @@ func transmit(ctx *TaskContext) error {
 	}
 	for _, rawURL := range imgList {
 		src, dst := GenRepoUrl(srcRepo.Registry, dstRepo.Registry, dstRepo.Repository, rawURL)
-		c.GenerateOnlineTask(src, srcRepo.User, srcRepo.Password, dst, dstRepo.User, dstRepo.Password)
+		c.GenerateOnlineTask(src, srcRepo, dst, dstRepo)
 	}
 	ctx.UpdateTotalTask(c.TaskLen())
 	startReport(ctx)
@@ -311,6 +526,9 @@ func watch(ctx *TaskContext) error {
 			return err
 		}
 		for {
+			if err := expandImgList(ctx, true); err != nil {
+				return err
+			}
 			for _, rawURL := range imgList {
 				if ctx.Cancel() {
 					ctx.Errorf(I18n.Sprintf("User cancelled..."))
@@ -321,7 +539,7 @@ func watch(ctx *TaskContext) error {
 				srcURL, _ := NewRepoURL(src)
 				dstURL, _ := NewRepoURL(dst)
 
-				imageSourceSrc, err := NewImageSource(ctx.Context, srcURL.GetRegistry(), srcURL.GetRepoWithNamespace(), "", srcRepo.User, srcRepo.Password, InsecureTarget(src))
+				imageSourceSrc, err := NewImageSource(ctx.Context, srcURL.GetRegistry(), srcURL.GetRepoWithNamespace(), "", srcRepo, InsecureTarget(src))
 				if err != nil {
 					log.Error(err)
 					return err
@@ -337,18 +555,19 @@ func watch(ctx *TaskContext) error {
 				for _, tag := range tags {
 					newSrcUrl := srcURL.GetRegistry() + "/" + srcURL.GetRepoWithNamespace() + ":" + tag
 					newDstUrl := dstURL.GetRegistry() + "/" + dstURL.GetRepoWithNamespace() + ":" + tag
-					if version.Compare(tag, srcURL.GetTag(), "<") || ctx.History.Skip(newSrcUrl) {
+					if (srcURL.GetTag() != "" && version.Compare(tag, srcURL.GetTag(), "<")) || ctx.History.Skip(newSrcUrl) ||
+						!lister.Match(srcURL.GetRepoWithNamespace()+":"+tag) {
 						continue
 					}
 
-					newImgSrc, err := NewImageSource(ctx.Context, srcURL.GetRegistry(), srcURL.GetRepoWithNamespace(), tag, srcRepo.User, srcRepo.Password, InsecureTarget(src))
+					newImgSrc, err := NewImageSource(ctx.Context, srcURL.GetRegistry(), srcURL.GetRepoWithNamespace(), tag, srcRepo, InsecureTarget(src))
 					if err != nil {
 						c.PutAInvalidTask(newSrcUrl)
 						ctx.Error(I18n.Sprintf("Url %s format error: %v, skipped", newSrcUrl, err))
 						continue
 					}
 
-					newImgDst, err := NewImageDestination(ctx.Context, dstURL.GetRegistry(), dstURL.GetRepoWithNamespace(), tag, dstRepo.User, dstRepo.Password, InsecureTarget(dst))
+					newImgDst, err := NewImageDestination(ctx.Context, dstURL.GetRegistry(), dstURL.GetRepoWithNamespace(), tag, dstRepo, InsecureTarget(dst))
 					if err != nil {
 						c.PutAInvalidTask(newSrcUrl)
 						ctx.Error(I18n.Sprintf("Url %s format error: %v, skipped", newDstUrl, err))
@@ -371,7 +590,12 @@ func watch(ctx *TaskContext) error {
 			}
 			ctx.UpdateTotalTask(ctx.GetTotalTask() + c.TaskLen())
 			c.Run()
+			if *flConfPrn {
+				pruneRepos(ctx)
+			}
 			fmt.Println(ctx.GetStatus())
+			// the destination may be pruned or changed before the next round
+			ctx.Converted = NewConvertedBlobs()
 			select {
 			case <-ctx.Context.Done():
 				ctx.Errorf(I18n.Sprintf("User cancelled..."))
@@ -384,6 +608,47 @@ func watch(ctx *TaskContext) error {
 	return nil
 }
 
+// pruneRepos prunes the destination repositories of the image list in the mirror mode, nothing is deleted with -plan
+func pruneRepos(ctx *TaskContext) error {
+	pruner, err := NewTagPruner(ctx, CONF.Prune, *flConfPln)
+	if err != nil {
+		return ctx.Errorf(I18n.Sprintf("Setup the prune failed: %v", err))
+	}
+	done := make(map[string]bool)
+	for _, rawURL := range imgList {
+		if ctx.Cancel() {
+			return ctx.Errorf(I18n.Sprintf("User cancelled..."))
+		}
+		src, dst := GenRepoUrl(srcRepo.Registry, dstRepo.Registry, dstRepo.Repository, rawURL)
+		srcURL, _ := NewRepoURL(strings.TrimPrefix(strings.TrimPrefix(src, "https://"), "http://"))
+		dstURL, _ := NewRepoURL(strings.TrimPrefix(strings.TrimPrefix(dst, "https://"), "http://"))
+		key := dstURL.GetRegistry() + "/" + dstURL.GetRepoWithNamespace()
+		if done[key] {
+			continue
+		}
+		done[key] = true
+
+		imgSrc, err := NewImageSource(ctx.Context, srcURL.GetRegistry(), srcURL.GetRepoWithNamespace(), "", srcRepo, InsecureTarget(src))
+		if err != nil {
+			ctx.Error(I18n.Sprintf("Url %s format error: %v, skipped", src, err))
+			continue
+		}
+		imgDst, err := NewImageDestination(ctx.Context, dstURL.GetRegistry(), dstURL.GetRepoWithNamespace(), "", dstRepo, InsecureTarget(dst))
+		if err != nil {
+			imgSrc.Close()
+			ctx.Error(I18n.Sprintf("Url %s format error: %v, skipped", dst, err))
+			continue
+		}
+		if err := pruner.Prune(imgSrc, imgDst); err != nil {
+			ctx.Error(err.Error())
+		}
+		imgSrc.Close()
+		imgDst.Close()
+	}
+	ctx.PrintReports()
+	return nil
+}
+
 func download(ctx *TaskContext) error {
 	if CONF.MaxConn > len(imgList) {
 		CONF.MaxConn = len(imgList)
@@ -417,21 +682,8 @@ func download(ctx *TaskContext) error {
 		workName = prefixFilename + "_" + workName
 	}
 
-	ctx.CreateCompressionMetadata(CONF.Compressor)
-
-	if len(*flConfInc) > 0 {
-		b, err := ioutil.ReadFile(*flConfInc)
-		if err != nil {
-			return fmt.Errorf(I18n.Sprintf("Open file failed: %v", err))
-		}
-		cm := new(CompressionMetadata)
-		err = yaml.Unmarshal(b, cm)
-		if err != nil {
-			return fmt.Errorf(I18n.Sprintf("Parse file failed(version incompatible or file corrupt?): %v", err))
-		}
-		for k := range cm.Blobs {
-			ctx.CompMeta.BlobDone(k, fmt.Sprintf("https://last.img/skip/it:%s", filepath.Base(*flConfInc)))
-		}
+	if err := loadIncMeta(ctx); err != nil {
+		return err
 	}
 
 	if SQUASHFS {
@@ -446,7 +698,7 @@ func download(ctx *TaskContext) error {
 	}
 	for _, rawURL := range imgList {
 		src, _ := GenRepoUrl(srcRepo.Registry, "", "", rawURL)
-		c.GenerateOfflineDownTask(src, srcRepo.User, srcRepo.Password)
+		c.GenerateOfflineDownTask(src, srcRepo)
 	}
 	startReport(ctx)
 	ctx.UpdateTotalTask(c.TaskLen())
@@ -477,40 +729,11 @@ func download(ctx *TaskContext) error {
 }
 
 func upload(ctx *TaskContext) error {
-	b, err := ioutil.ReadFile(*flConfImg)
+	pathname, err := loadImgMeta(ctx)
 	if err != nil {
-		return ctx.Errorf(I18n.Sprintf("Open file failed: %v", err))
-	}
-	cm := new(CompressionMetadata)
-	err = yaml.Unmarshal(b, cm)
-	if err != nil {
-		return ctx.Errorf(I18n.Sprintf("Parse file failed(version incompatible or file corrupt?): %v", err))
-	}
-	pathname := filepath.Dir(*flConfImg)
-
-	ctx.CompMeta = cm
-
-	for k, v := range cm.Datafiles {
-		f, err := os.Stat(filepath.Join(pathname, k))
-		if err != nil && os.IsNotExist(err) {
-			return ctx.Errorf(I18n.Sprintf("Datafile %s missing", filepath.Join(pathname, k)))
-
-		} else if f.Size() != v {
-			return ctx.Errorf(I18n.Sprintf("Datafile %s mismatch in size, origin: %v, now: %v", filepath.Join(pathname, k), v, f.Size()))
-		}
-	}
-
-	var srcImgUrlList []string
-	for k := range cm.Manifests {
-		srcImgUrlList = append(srcImgUrlList, k)
-	}
-	ctx.Info(I18n.Sprintf("The img file contains %v images:\n%s", len(cm.Manifests), strings.Join(srcImgUrlList, "\n")))
-
-	if len(*flConfLst) > 0 {
-		readImgList(ctx)
-	} else {
-		getInputList(strings.Join(srcImgUrlList, "\n")) // if no input list then take the original
+		return err
 	}
+	cm := ctx.CompMeta
 
 	if ctx.CompMeta.Compressor == "squashfs" {
 		var filename string
@@ -544,9 +767,9 @@ func upload(ctx *TaskContext) error {
 		src, dst := GenRepoUrl("", dstRepo.Registry, dstRepo.Repository, rawURL)
 		if dstRepo.Name == "docker" || dstRepo.Name == "ctr" {
 			ctx.DockerTarget = dstRepo.Name
-			c.GenerateOfflineUploadTask(src, "", pathname, dstRepo.User, dstRepo.Password)
+			c.GenerateOfflineUploadTask(src, "", pathname, dstRepo)
 		} else {
-			c.GenerateOfflineUploadTask(src, dst, pathname, dstRepo.User, dstRepo.Password)
+			c.GenerateOfflineUploadTask(src, dst, pathname, dstRepo)
 		}
 	}
 	ctx.UpdateTotalTask(c.TaskLen())
@@ -556,6 +779,117 @@ func upload(ctx *TaskContext) error {
 	return nil
 }
 
+// loadIncMeta creates the CompressionMetadata of a download, the blobs of the "-inc" meta file are marked as done
+func loadIncMeta(ctx *TaskContext) error {
+	ctx.CreateCompressionMetadata(CONF.Compressor)
+
+	if len(*flConfInc) > 0 {
+		b, err := ioutil.ReadFile(*flConfInc)
+		if err != nil {
+			return WrapError(err, I18n.Sprintf("Open file failed: %v", err))
+		}
+		cm := new(CompressionMetadata)
+		err = yaml.Unmarshal(b, cm)
+		if err != nil {
+			return WrapError(err, I18n.Sprintf("Parse file failed(version incompatible or file corrupt?): %v", err))
+		}
+		for k := range cm.Blobs {
+			ctx.CompMeta.BlobDone(k, fmt.Sprintf("https://last.img/skip/it:%s", filepath.Base(*flConfInc)))
+		}
+	}
+	return nil
+}
+
+// loadImgMeta reads the "-img" meta file of an upload and checks the datafiles, returns the path of the datafiles
+func loadImgMeta(ctx *TaskContext) (string, error) {
+	b, err := ioutil.ReadFile(*flConfImg)
+	if err != nil {
+		return "", ctx.Errorf(I18n.Sprintf("Open file failed: %v", err))
+	}
+	cm := new(CompressionMetadata)
+	err = yaml.Unmarshal(b, cm)
+	if err != nil {
+		return "", ctx.Errorf(I18n.Sprintf("Parse file failed(version incompatible or file corrupt?): %v", err))
+	}
+	pathname := filepath.Dir(*flConfImg)
+
+	ctx.CompMeta = cm
+
+	for k, v := range cm.Datafiles {
+		f, err := os.Stat(filepath.Join(pathname, k))
+		if err != nil && os.IsNotExist(err) {
+			return "", ctx.Errorf(I18n.Sprintf("Datafile %s missing", filepath.Join(pathname, k)))
+
+		} else if f.Size() != v {
+			return "", ctx.Errorf(I18n.Sprintf("Datafile %s mismatch in size, origin: %v, now: %v", filepath.Join(pathname, k), v, f.Size()))
+		}
+	}
+
+	var srcImgUrlList []string
+	for k := range cm.Manifests {
+		srcImgUrlList = append(srcImgUrlList, k)
+	}
+	ctx.Info(I18n.Sprintf("The img file contains %v images:\n%s", len(cm.Manifests), strings.Join(srcImgUrlList, "\n")))
+
+	if len(*flConfLst) > 0 {
+		readImgList(ctx)
+	} else {
+		getInputList(strings.Join(srcImgUrlList, "\n")) // if no input list then take the original
+	}
+	return pathname, nil
+}
+
+func planTransmit(ctx *TaskContext) error {
+	p := NewPlanner(ctx, "transmit")
+	p.Run(imgList, CONF.MaxConn, func(rawURL string) *PlanImage {
+		src, dst := GenRepoUrl(srcRepo.Registry, dstRepo.Registry, dstRepo.Repository, rawURL)
+		return p.PlanOnline(src, srcRepo, dst, dstRepo)
+	})
+	return endPlan(ctx, p)
+}
+
+func planDownload(ctx *TaskContext) error {
+	if err := loadIncMeta(ctx); err != nil {
+		return ctx.Errorf("%v", err)
+	}
+	p := NewPlanner(ctx, "download")
+	p.Run(imgList, CONF.MaxConn, func(rawURL string) *PlanImage {
+		src, _ := GenRepoUrl(srcRepo.Registry, "", "", rawURL)
+		return p.PlanDownload(src, srcRepo)
+	})
+	return endPlan(ctx, p)
+}
+
+func planUpload(ctx *TaskContext) error {
+	if _, err := loadImgMeta(ctx); err != nil {
+		return err
+	}
+	p := NewPlanner(ctx, "upload")
+	p.Run(imgList, CONF.MaxConn, func(rawURL string) *PlanImage {
+		src, dst := GenRepoUrl("", dstRepo.Registry, dstRepo.Repository, rawURL)
+		if dstRepo.Name == "docker" || dstRepo.Name == "ctr" {
+			return p.PlanUpload(src, "", dstRepo)
+		}
+		return p.PlanUpload(src, dst, dstRepo)
+	})
+	return endPlan(ctx, p)
+}
+
+// endPlan prints the plan and saves it in json
+func endPlan(ctx *TaskContext, p *Planner) error {
+	p.Print()
+	filename := *flConfPlo
+	if len(filename) == 0 {
+		filename = time.Now().Format("plan_200601021504.json")
+	}
+	if err := p.Save(filename); err != nil {
+		return ctx.Errorf(I18n.Sprintf("Save the plan failed: %v", err))
+	}
+	ctx.Info(I18n.Sprintf("Save the plan to %s", filename))
+	log.Flush()
+	return nil
+}
+
 func WriteMetaFile(ctx *TaskContext, pathname string, filename string) error {
 	for k := range ctx.CompMeta.Datafiles {
 		i, err := os.Stat(filepath.Join(pathname, k))
@@ -581,6 +915,7 @@ func WriteMetaFile(ctx *TaskContext, pathname string, filename string) error {
 func BeginAction(ctx *TaskContext) bool {
 	ctx.Info(I18n.Sprintf("==============BEGIN=============="))
 	ctx.Info(I18n.Sprintf("Transmit params: max threads: %v, max retries: %v", CONF.MaxConn, CONF.Retries))
+	ctx.SetMaxStreams(CONF.MaxStreams)
 	ctx.UpdateSecStart(time.Now().Unix())
 	return true
 }
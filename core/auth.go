@@ -0,0 +1,177 @@
+package core
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+
+	log "github.com/cihub/seelog"
+	helperclient "github.com/docker/docker-credential-helpers/client"
+	"github.com/docker/docker-credential-helpers/credentials"
+)
+
+const (
+	// docker saves the credentials of docker hub with this key
+	dockerHubAuthKey = "https://index.docker.io/v1/"
+	// the username of an identity token(an OAuth2 refresh token), returned by the credential helpers like docker does
+	IDENTITY_TOKEN_USER = "<token>"
+)
+
+var (
+	// the credentials found in the authfiles, keyed by the authfile and the registry, so that the authfile is read
+	// and the credential helper is run only once for a registry
+	authCache     = make(map[string]credential)
+	authCacheLock sync.Mutex
+)
+
+type credential struct {
+	username string
+	password string
+}
+
+// DockerConfig is the credential part of the docker config.json
+type DockerConfig struct {
+	Auths       map[string]DockerAuth `json:"auths,omitempty"`
+	CredsStore  string                `json:"credsStore,omitempty"`
+	CredHelpers map[string]string     `json:"credHelpers,omitempty"`
+}
+
+// DockerAuth is an entry of the "auths" in docker config.json
+type DockerAuth struct {
+	Auth          string `json:"auth,omitempty"`
+	Username      string `json:"username,omitempty"`
+	Password      string `json:"password,omitempty"`
+	IdentityToken string `json:"identitytoken,omitempty"`
+}
+
+// GetCredentials returns the username and password of a registry for the repo, the user and password in cfg.yaml
+// come first, or they are looked up in the authfile of the repo(~/.docker/config.json by default):
+// the credHelpers of the registry, the credsStore and then the auths entries, just like docker does.
+// An identity token is returned with the username IDENTITY_TOKEN_USER.
+func GetCredentials(repo *Repo, registry string) (string, string, error) {
+	var authFile string
+	if repo != nil {
+		if repo.User != "" && repo.Password != "" {
+			return repo.User, repo.Password, nil
+		}
+		authFile = repo.AuthFile
+	}
+
+	explicit := authFile != ""
+	if !explicit {
+		authFile = DefaultAuthFile()
+		if authFile == "" {
+			return "", "", nil
+		}
+	} else if strings.HasPrefix(authFile, "~/") {
+		home, err := os.UserHomeDir()
+		if err != nil {
+			return "", "", err
+		}
+		authFile = filepath.Join(home, authFile[2:])
+	}
+
+	key := authFile + "@" + normalizeAuthKey(registry)
+	authCacheLock.Lock()
+	defer authCacheLock.Unlock()
+	if c, ok := authCache[key]; ok {
+		return c.username, c.password, nil
+	}
+	username, password, err := readCredentials(authFile, explicit, registry)
+	if err != nil {
+		return "", "", err
+	}
+	authCache[key] = credential{username: username, password: password}
+	return username, password, nil
+}
+
+// readCredentials looks up the credentials of the registry in the authfile
+func readCredentials(authFile string, explicit bool, registry string) (string, string, error) {
+	b, err := ioutil.ReadFile(authFile)
+	if err != nil {
+		if os.IsNotExist(err) && !explicit {
+			return "", "", nil
+		}
+		return "", "", err
+	}
+	var conf DockerConfig
+	if err := json.Unmarshal(b, &conf); err != nil {
+		return "", "", fmt.Errorf("invalid docker config file %s: %v", authFile, err)
+	}
+
+	host := normalizeAuthKey(registry)
+	serverURL := host
+	if host == "index.docker.io" {
+		serverURL = dockerHubAuthKey
+	}
+
+	helper := conf.CredsStore
+	for k, v := range conf.CredHelpers {
+		if normalizeAuthKey(k) == host {
+			helper = v
+			break
+		}
+	}
+	if helper != "" {
+		creds, err := helperclient.Get(helperclient.NewShellProgramFunc("docker-credential-"+helper), serverURL)
+		if err == nil {
+			log.Debugf("Use the credentials of %s from docker-credential-%s", registry, helper)
+			return creds.Username, creds.Secret, nil
+		}
+		if !credentials.IsErrCredentialsNotFound(err) {
+			return "", "", fmt.Errorf("get credentials of %s from docker-credential-%s error: %v", registry, helper, err)
+		}
+	}
+
+	for k, v := range conf.Auths {
+		if normalizeAuthKey(k) != host {
+			continue
+		}
+		if v.IdentityToken != "" {
+			log.Debugf("Use the identity token of %s from %s", registry, authFile)
+			return IDENTITY_TOKEN_USER, v.IdentityToken, nil
+		}
+		if v.Auth == "" {
+			return v.Username, v.Password, nil
+		}
+		decoded, err := base64.StdEncoding.DecodeString(v.Auth)
+		if err != nil {
+			return "", "", fmt.Errorf("invalid auth of %s in %s: %v", k, authFile, err)
+		}
+		seg := strings.SplitN(string(decoded), ":", 2)
+		if len(seg) != 2 {
+			return "", "", fmt.Errorf("invalid auth of %s in %s", k, authFile)
+		}
+		log.Debugf("Use the credentials of %s from %s", registry, authFile)
+		return seg[0], strings.Trim(seg[1], "\x00"), nil
+	}
+	return "", "", nil
+}
+
+// DefaultAuthFile returns the config.json of docker, $DOCKER_CONFIG is respected
+func DefaultAuthFile() string {
+	if dir := os.Getenv("DOCKER_CONFIG"); dir != "" {
+		return filepath.Join(dir, "config.json")
+	}
+	home, err := os.UserHomeDir()
+	if err != nil {
+		return ""
+	}
+	return filepath.Join(home, ".docker", "config.json")
+}
+
+// normalizeAuthKey turns the keys like "https://index.docker.io/v1/" to a hostname
+func normalizeAuthKey(key string) string {
+	key = strings.TrimPrefix(strings.TrimPrefix(key, "http://"), "https://")
+	key = strings.SplitN(key, "/", 2)[0]
+	switch key {
+	case "docker.io", "registry-1.docker.io", "registry.hub.docker.com":
+		return "index.docker.io"
+	}
+	return key
+}
@@ -0,0 +1,214 @@
+package core
+
+import (
+	"fmt"
+	"net/http"
+	"regexp"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+var (
+	// the repositories requested in each page of the "_catalog" API
+	CATALOG_PAGE_SIZE = 100
+)
+
+// FilterCfg filters the images expanded from the wildcard entries of the image list and the tags found by the watch mode
+type FilterCfg struct {
+	// regular expressions matching "namespace/repository:tag", an image is kept if it matches any of them, all kept if empty
+	Include []string `yaml:"include,omitempty"`
+	// an image matching any of these regular expressions is dropped
+	Exclude []string `yaml:"exclude,omitempty"`
+}
+
+// ImageLister expands the wildcard entries of the image list: "registry/project/*" to the images of all the
+// repositories under the project found by the "_catalog" API, "registry/project/app:*" to all the tags of the repository
+type ImageLister struct {
+	ctx     *TaskContext
+	repo    *Repo
+	include []*regexp.Regexp
+	exclude []*regexp.Regexp
+	// the registries are listed by one endpoint each, keyed by registry
+	endpoints map[string]*sourceEndpoint
+}
+
+// NewImageLister creates an ImageLister for the source repo
+func NewImageLister(ctx *TaskContext, repo *Repo, cfg FilterCfg) (*ImageLister, error) {
+	l := &ImageLister{
+		ctx:       ctx,
+		repo:      repo,
+		endpoints: make(map[string]*sourceEndpoint),
+	}
+	for _, s := range cfg.Include {
+		r, err := regexp.Compile(s)
+		if err != nil {
+			return nil, fmt.Errorf("invalid include filter %s: %v", s, err)
+		}
+		l.include = append(l.include, r)
+	}
+	for _, s := range cfg.Exclude {
+		r, err := regexp.Compile(s)
+		if err != nil {
+			return nil, fmt.Errorf("invalid exclude filter %s: %v", s, err)
+		}
+		l.exclude = append(l.exclude, r)
+	}
+	return l, nil
+}
+
+// IsWildcard checks if the source of an image list entry is a wildcard, "project/*" or "project/app:*"
+func IsWildcard(rawURL string) bool {
+	src := strings.TrimSpace(strings.Split(rawURL, "->")[0])
+	return src == "*" || strings.HasSuffix(src, "/*") || strings.HasSuffix(src, ":*")
+}
+
+// Match checks the image "namespace/repository:tag" against the include and exclude filters
+func (l *ImageLister) Match(image string) bool {
+	for _, r := range l.exclude {
+		if r.MatchString(image) {
+			return false
+		}
+	}
+	if len(l.include) == 0 {
+		return true
+	}
+	for _, r := range l.include {
+		if r.MatchString(image) {
+			return true
+		}
+	}
+	return false
+}
+
+// Expand replaces the wildcard entries of the list by the images found in the source registry, the others are kept.
+// The tags are not listed if repoOnly, the repositories are returned for the watch mode to list the tags itself.
+func (l *ImageLister) Expand(srcReg string, list []string, repoOnly bool) ([]string, error) {
+	var expanded []string
+	for _, rawURL := range list {
+		if !IsWildcard(rawURL) {
+			expanded = append(expanded, rawURL)
+			continue
+		}
+		entries, err := l.expand(srcReg, rawURL, repoOnly)
+		if err != nil {
+			return nil, err
+		}
+		l.ctx.Info(I18n.Sprintf("Expand %s to %v entries", rawURL, len(entries)))
+		expanded = append(expanded, entries...)
+	}
+	return expanded, nil
+}
+
+// expand a wildcard entry, the "*" of the source and of the renamed destination are replaced by the same thing
+func (l *ImageLister) expand(srcReg string, rawURL string, repoOnly bool) ([]string, error) {
+	srcPart, dstPart := strings.TrimSpace(rawURL), ""
+	if strings.Contains(rawURL, "->") {
+		t := strings.SplitN(rawURL, "->", 2)
+		srcPart, dstPart = strings.TrimSpace(t[0]), strings.TrimSpace(t[1])
+	}
+	tagOnly := strings.HasSuffix(srcPart, ":*")
+	if dstPart != "" && (strings.HasSuffix(dstPart, ":*") != tagOnly || !strings.HasSuffix(dstPart, "*")) {
+		return nil, errors.New(I18n.Sprintf("The destination of %s should end with the same wildcard as the source", rawURL))
+	}
+
+	src, _ := GenRepoUrl(srcReg, "", "", srcPart)
+	srcURL, err := NewRepoURL(strings.TrimPrefix(strings.TrimPrefix(src, "https://"), "http://"))
+	if err != nil {
+		return nil, err
+	}
+	insecure := InsecureTarget(src)
+
+	var prefix string
+	var repositories []string
+	if tagOnly {
+		repositories = []string{srcURL.GetRepoWithNamespace()}
+	} else {
+		prefix = strings.TrimSuffix(srcURL.GetRepoWithNamespace(), "*")
+		all, err := l.listRepositories(srcURL.GetRegistry(), insecure)
+		if code := statusCode(err); code == http.StatusUnauthorized || code == http.StatusForbidden {
+			return nil, WrapError(err, I18n.Sprintf("List the repositories of %s is denied: %v, the \"_catalog\" API needs an account with the permission of the whole registry(ex: the system admin of Harbor, the robot accounts are refused), or list the repositories by \"project/app:*\" instead", srcURL.GetRegistry(), err))
+		}
+		if err != nil {
+			return nil, WrapError(err, I18n.Sprintf("List the repositories of %s failed: %v", srcURL.GetRegistry(), err))
+		}
+		for _, r := range all {
+			if strings.HasPrefix(r, prefix) {
+				repositories = append(repositories, r)
+			}
+		}
+	}
+
+	var entries []string
+	add := func(replacement string) {
+		entry := strings.TrimSuffix(srcPart, "*") + replacement
+		if dstPart != "" {
+			entry = entry + " -> " + strings.TrimSuffix(dstPart, "*") + replacement
+		}
+		entries = append(entries, entry)
+	}
+	for _, r := range repositories {
+		if l.ctx.Cancel() {
+			return nil, errors.New(I18n.Sprintf("User cancelled..."))
+		}
+		if repoOnly {
+			if tagOnly {
+				entry := strings.TrimSuffix(srcPart, ":*")
+				if dstPart != "" {
+					entry = entry + " -> " + strings.TrimSuffix(dstPart, ":*")
+				}
+				entries = append(entries, entry)
+			} else {
+				add(strings.TrimPrefix(r, prefix))
+			}
+			continue
+		}
+
+		tags, err := l.listTags(srcURL.GetRegistry(), r, insecure)
+		if err != nil {
+			return nil, WrapError(err, I18n.Sprintf("Fetch tag list failed for %v with error: %v", srcURL.GetRegistry()+"/"+r, err))
+		}
+		for _, tag := range tags {
+			if !l.Match(r + ":" + tag) {
+				continue
+			}
+			if tagOnly {
+				add(tag)
+			} else {
+				add(strings.TrimPrefix(r, prefix) + ":" + tag)
+			}
+		}
+	}
+	return entries, nil
+}
+
+// listRepositories lists all the repositories of the registry, the mirrors of the repo are not used
+func (l *ImageLister) listRepositories(registry string, insecure bool) ([]string, error) {
+	endpoint, err := l.endpoint(registry, insecure)
+	if err != nil {
+		return nil, err
+	}
+	return endpoint.client.GetCatalog(l.ctx.Context)
+}
+
+// listTags lists the tags of a repository by the client of the registry, the mirrors of the repo are not used
+func (l *ImageLister) listTags(registry string, repository string, insecure bool) ([]string, error) {
+	endpoint, err := l.endpoint(registry, insecure)
+	if err != nil {
+		return nil, err
+	}
+	return endpoint.client.GetTags(l.ctx.Context, repository)
+}
+
+// endpoint returns the endpoint of the registry, created once so that the credentials and the tokens are reused
+func (l *ImageLister) endpoint(registry string, insecure bool) (*sourceEndpoint, error) {
+	if endpoint, ok := l.endpoints[registry]; ok {
+		return endpoint, nil
+	}
+	endpoint, err := newSourceEndpoint(registry, l.repo, insecure)
+	if err != nil {
+		return nil, err
+	}
+	l.endpoints[registry] = endpoint
+	return endpoint, nil
+}
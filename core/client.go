@@ -2,6 +2,7 @@ package core
 
 import (
 	"container/list"
+	"fmt"
 	"strings"
 	"sync"
 	"time"
@@ -26,12 +27,22 @@ type Client struct {
 	routineNum     int
 	retries        int
 	ctx            *TaskContext
+	// the failures of the tasks, guarded by failedTaskListChan
+	histories   map[Task]*retryHistory
+	failedOrder []Task
 	// mutex
 	taskListChan        chan int
 	failedTaskListChan  chan int
 	invalidTaskListChan chan int
 }
 
+// retryHistory records the failures of a task
+type retryHistory struct {
+	errors     []string
+	permanent  bool
+	retryAfter time.Duration
+}
+
 // NewClient creates a syncronization client
 func NewClient(routineNum int, retries int, logger *TaskContext) (*Client, error) {
 	return &Client{
@@ -40,6 +51,7 @@ func NewClient(routineNum int, retries int, logger *TaskContext) (*Client, error
 		routineNum:          routineNum,
 		retries:             retries,
 		ctx:                 logger,
+		histories:           make(map[Task]*retryHistory),
 		taskListChan:        make(chan int, 1),
 		failedTaskListChan:  make(chan int, 1),
 		invalidTaskListChan: make(chan int, 1),
@@ -67,6 +79,7 @@ func (c *Client) Run() {
 					if err := task.Run(tid); err != nil {
 						errLog := I18n.Sprintf("Task failed with %v", err)
 						c.ctx.Error(errLog)
+						c.recordFailure(task, err)
 						c.PutAFailedTask(task)
 						task.Callback(false, errLog)
 					} else {
@@ -88,18 +101,28 @@ func (c *Client) Run() {
 	// generate goroutines to handle tasks
 	openRoutinesHandleTaskAndWaitForFinish()
 
-	for times := 0; times < c.retries; times++ {
-		if c.failedTaskList.Len() != 0 {
-			c.taskList.PushBackList(c.failedTaskList)
-			c.failedTaskList.Init()
+	for times := 0; times < c.retries && !c.ctx.Cancel(); times++ {
+		retryAfter := c.requeueFailedTasks()
+		if c.taskList.Len() == 0 {
+			break
 		}
 
-		if c.taskList.Len() != 0 {
-			// gzRetries to handle task
-			c.ctx.Info(I18n.Sprintf("Start Retry failed tasks"))
-			openRoutinesHandleTaskAndWaitForFinish()
+		// back off before retrying, the registry may be limiting the rate
+		wait := RetryBackoff(times, retryAfter)
+		c.ctx.Info(I18n.Sprintf("Wait %v before retrying %v failed tasks", wait.Round(100*time.Millisecond), c.taskList.Len()))
+		select {
+		case <-time.After(wait):
+		case <-c.ctx.Context.Done():
 		}
+		if c.ctx.Cancel() {
+			break
+		}
+
+		// gzRetries to handle task
+		c.ctx.Info(I18n.Sprintf("Start Retry failed tasks"))
+		openRoutinesHandleTaskAndWaitForFinish()
 	}
+	c.reportRetries()
 
 	c.ctx.Info(I18n.Sprintf("Task completed, total %v tasks with %v failed", c.ctx.totalTask, c.failedTaskList.Len()))
 	if c.failedTaskList.Len() > 0 {
@@ -114,18 +137,19 @@ func (c *Client) Run() {
 		c.ctx.Info(I18n.Sprintf("WARNING: there are %v images failed with invalid url(ex:image not exists)", len(c.invalidTasks)))
 		c.ctx.Info(I18n.Sprintf("Invalid url list:\r\n%s", strings.Join(c.invalidTasks, "\r\n")))
 	}
+	c.ctx.PrintReports()
 }
 
-func (c *Client) GenerateOnlineTask(imgSrc string, userSrc string, pswdStr string, imgDst string, userDst string, pswdDst string) error {
+func (c *Client) GenerateOnlineTask(imgSrc string, srcRepo *Repo, imgDst string, dstRepo *Repo) error {
 	srcURL, _ := NewRepoURL(strings.TrimPrefix(strings.TrimPrefix(imgSrc, "https://"), "http://"))
-	imageSourceSrc, err := NewImageSource(c.ctx.Context, srcURL.GetRegistry(), srcURL.GetRepoWithNamespace(), srcURL.GetTag(), userSrc, pswdStr, InsecureTarget(imgSrc))
+	imageSourceSrc, err := NewImageSource(c.ctx.Context, srcURL.GetRegistry(), srcURL.GetRepoWithNamespace(), srcURL.GetTag(), srcRepo, InsecureTarget(imgSrc))
 	if err != nil {
 		c.PutAInvalidTask(imgSrc)
 		return c.ctx.Errorf(I18n.Sprintf("Url %s format error: %v, skipped", imgSrc, err))
 	}
 
 	dstURL, _ := NewRepoURL(strings.TrimPrefix(strings.TrimPrefix(imgDst, "https://"), "http://"))
-	imageSourceDst, err := NewImageDestination(c.ctx.Context, dstURL.GetRegistry(), dstURL.GetRepoWithNamespace(), dstURL.GetTag(), userDst, pswdDst, InsecureTarget(imgDst))
+	imageSourceDst, err := NewImageDestination(c.ctx.Context, dstURL.GetRegistry(), dstURL.GetRepoWithNamespace(), dstURL.GetTag(), dstRepo, InsecureTarget(imgDst))
 	if err != nil {
 		c.PutAInvalidTask(imgDst)
 		return c.ctx.Errorf(I18n.Sprintf("Url %s format error: %v, skipped", imgDst, err))
@@ -136,14 +160,14 @@ func (c *Client) GenerateOnlineTask(imgSrc string, userSrc string, pswdStr strin
 	return nil
 }
 
-func (c *Client) GenerateOfflineDownTask(url string, username string, password string) error {
+func (c *Client) GenerateOfflineDownTask(url string, repo *Repo) error {
 	srcURL, err := NewRepoURL(strings.TrimPrefix(strings.TrimPrefix(url, "https://"), "http://"))
 	if err != nil {
 		c.PutAInvalidTask(url)
 		return c.ctx.Errorf(I18n.Sprintf("Url %s format error: %v, skipped", url, err))
 	}
 	is, err := NewImageSource(c.ctx.Context, srcURL.GetRegistry(), srcURL.GetRepoWithNamespace(), srcURL.GetTag(),
-		username, password, InsecureTarget(url))
+		repo, InsecureTarget(url))
 	if err != nil {
 		c.PutAInvalidTask(url)
 		return c.ctx.Errorf(I18n.Sprintf("Url %s format error: %v, skipped", url, err))
@@ -154,12 +178,12 @@ func (c *Client) GenerateOfflineDownTask(url string, username string, password s
 	return nil
 }
 
-func (c *Client) GenerateOfflineUploadTask(srcUrl string, url string, path string, username string, password string) error {
+func (c *Client) GenerateOfflineUploadTask(srcUrl string, url string, path string, repo *Repo) error {
 	var ids *ImageDestination
 	if url != "" {
 		dstURL, _ := NewRepoURL(strings.TrimPrefix(strings.TrimPrefix(url, "https://"), "http://"))
 		var err error
-		ids, err = NewImageDestination(c.ctx.Context, dstURL.GetRegistry(), dstURL.GetRepoWithNamespace(), dstURL.GetTag(), username, password, InsecureTarget(url))
+		ids, err = NewImageDestination(c.ctx.Context, dstURL.GetRegistry(), dstURL.GetRepoWithNamespace(), dstURL.GetTag(), repo, InsecureTarget(url))
 		if err != nil {
 			c.PutAInvalidTask(url)
 			return c.ctx.Errorf(I18n.Sprintf("Url %s format error: %v, skipped", url, err))
@@ -217,6 +241,75 @@ func (c *Client) GetAFailedTask() (Task, bool) {
 	return failedTask.Value.(Task), false
 }
 
+// recordFailure saves the error of a failed task for the classification and the report
+func (c *Client) recordFailure(task Task, err error) {
+	c.failedTaskListChan <- 1
+	defer func() {
+		<-c.failedTaskListChan
+	}()
+	h, ok := c.histories[task]
+	if !ok {
+		h = &retryHistory{}
+		c.histories[task] = h
+		c.failedOrder = append(c.failedOrder, task)
+	}
+	h.errors = append(h.errors, err.Error())
+	h.permanent = IsPermanentError(err)
+	h.retryAfter = RetryAfter(err)
+	if h.permanent {
+		c.ctx.Info(I18n.Sprintf("Task %s failed with a permanent error, will not retry", task.Name()))
+	}
+}
+
+// requeueFailedTasks moves the failed tasks to the task list except the permanent ones,
+// returns the longest "Retry-After" of them
+func (c *Client) requeueFailedTasks() time.Duration {
+	c.failedTaskListChan <- 1
+	defer func() {
+		<-c.failedTaskListChan
+	}()
+	var retryAfter time.Duration
+	for e := c.failedTaskList.Front(); e != nil; {
+		next := e.Next()
+		task := e.Value.(Task)
+		if h, ok := c.histories[task]; !ok || !h.permanent {
+			if ok && h.retryAfter > retryAfter {
+				retryAfter = h.retryAfter
+			}
+			c.failedTaskList.Remove(e)
+			c.PutATask(task)
+		}
+		e = next
+	}
+	c.ctx.UpdateFailedTask(c.failedTaskList.Len())
+	return retryAfter
+}
+
+// reportRetries adds the failures of each task to the final report
+func (c *Client) reportRetries() {
+	c.failedTaskListChan <- 1
+	defer func() {
+		<-c.failedTaskListChan
+	}()
+	failed := make(map[Task]bool)
+	for e := c.failedTaskList.Front(); e != nil; e = e.Next() {
+		failed[e.Value.(Task)] = true
+	}
+	for _, task := range c.failedOrder {
+		h := c.histories[task]
+		var line string
+		if failed[task] {
+			line = I18n.Sprintf("%s failed after %v attempts", task.Name(), len(h.errors))
+		} else {
+			line = I18n.Sprintf("%s succeeded after %v attempts", task.Name(), len(h.errors)+1)
+		}
+		for i, e := range h.errors {
+			line = line + fmt.Sprintf("\r\n    #%v %s", i+1, e)
+		}
+		c.ctx.Report(I18n.Sprintf("Retry history"), line)
+	}
+}
+
 // PutAFailedTask puts a failed task to failedTaskList
 func (c *Client) PutAFailedTask(failedTask Task) {
 	c.failedTaskListChan <- 1
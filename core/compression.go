@@ -11,11 +11,13 @@ import (
 	"io/ioutil"
 	"os"
 	"os/exec"
+	"runtime"
 	"strings"
 	"sync"
 	"time"
 
 	log "github.com/cihub/seelog"
+	"github.com/containers/image/v5/manifest"
 	"github.com/containers/image/v5/types"
 	"github.com/klauspost/compress/zstd"
 	"github.com/pierrec/lz4"
@@ -23,25 +25,28 @@ import (
 )
 
 type CompressionMetadata struct {
-	m          sync.Mutex
-	Datafiles  map[string]int64
-	Compressor string
-	Blobs      map[string][]string
-	Manifests  map[string]string
-	BlobDoing  map[string]int
+	m            sync.Mutex
+	Datafiles    map[string]int64
+	Compressor   string
+	Blobs        map[string][]string
+	Manifests    map[string]string
+	SubManifests map[string]string
+	BlobDoing    map[string]int
 }
 
 func NewCompressionMetadata(compressor string) (*CompressionMetadata, error) {
 	blobs := make(map[string][]string)
 	manifests := make(map[string]string)
+	subManifests := make(map[string]string)
 	datafiles := make(map[string]int64)
 	blobDoing := make(map[string]int)
 	return &CompressionMetadata{
-		Blobs:      blobs,
-		Manifests:  manifests,
-		Datafiles:  datafiles,
-		Compressor: compressor,
-		BlobDoing:  blobDoing,
+		Blobs:        blobs,
+		Manifests:    manifests,
+		SubManifests: subManifests,
+		Datafiles:    datafiles,
+		Compressor:   compressor,
+		BlobDoing:    blobDoing,
 	}, nil
 }
 
@@ -90,6 +95,43 @@ func (c *CompressionMetadata) AddImage(name string, manifest string) {
 	c.Manifests[name] = manifest
 }
 
+// AddSubManifest saves a platform specified manifest of a manifest list by its digest
+func (c *CompressionMetadata) AddSubManifest(digest string, manifest string) {
+	c.m.Lock()
+	defer c.m.Unlock()
+	c.SubManifests[digest] = manifest
+}
+
+// PlatformManifest returns the manifest of the current architecture if the given one is a manifest list,
+// docker archive could only hold one platform of an image
+func (c *CompressionMetadata) PlatformManifest(manifestJson string) (string, error) {
+	manifestType := manifest.GuessMIMEType([]byte(manifestJson))
+	if !manifest.MIMETypeIsMultiImage(manifestType) {
+		return manifestJson, nil
+	}
+	descriptors, err := ManifestListDescriptors([]byte(manifestJson), manifestType)
+	if err != nil {
+		return "", err
+	}
+	if len(descriptors) < 1 {
+		return "", fmt.Errorf("empty manifest list")
+	}
+	choice := descriptors[0]
+	for _, d := range descriptors {
+		if d.OS == "linux" && d.Architecture == runtime.GOARCH {
+			choice = d
+			break
+		}
+	}
+	c.m.Lock()
+	defer c.m.Unlock()
+	subManifest, ok := c.SubManifests[choice.Digest.String()]
+	if !ok {
+		return "", fmt.Errorf("manifest %s of the manifest list not found", choice.Digest)
+	}
+	return subManifest, nil
+}
+
 func (c *CompressionMetadata) AddDatafile(name string, num int64) {
 	c.m.Lock()
 	defer c.m.Unlock()
@@ -168,10 +210,9 @@ func (s *SingleTarWriter) Run() {
 				hex := ff.Name()[0:strings.Index(ff.Name(), ".")]
 				if strings.HasSuffix(ff.Name(), ".json") {
 					err = s.d.AppendFileStream(ff.Name(), ff.Size(), file)
-				} else if strings.HasSuffix(ff.Name(), ".tar.gz") {
-					err = s.d.AppendFileStream(hex+"/"+"layer.tar.gz", ff.Size(), file)
 				} else {
-					err = s.d.AppendFileStream(hex+"/"+"layer.raw", ff.Size(), file)
+					// keep the same suffix as GetBlobSuffix, AppendMeta refers the layers with it
+					err = s.d.AppendFileStream(hex+"/"+"layer"+ff.Name()[len(hex):], ff.Size(), file)
 				}
 			}
 			if err != nil {
@@ -190,6 +231,11 @@ func (s *SingleTarWriter) SaveDockerMeta(cm *CompressionMetadata) {
 	}
 	for k, v := range cm.Manifests {
 		m := Manifest{}
+		v, err := cm.PlatformManifest(v)
+		if err != nil {
+			log.Errorf("Skip %s: %v", k, err)
+			continue
+		}
 		manifestByte := []byte(v)
 		json.Unmarshal(manifestByte, &m)
 		s.d.AppendMeta(&m, k)
@@ -485,8 +531,10 @@ func (d *DockerSaver) AppendFileStream(filename string, size int64, reader io.Re
 
 func GetBlobSuffix(b types.BlobInfo) string {
 	// skip some empty gzip layers or tar-split will failed, and lots of empty HEXs here, using size more safe
-	if strings.HasSuffix(b.MediaType, "tar.gzip") && b.Size > 32 {
+	if (strings.HasSuffix(b.MediaType, "tar.gzip") || strings.HasSuffix(b.MediaType, "tar+gzip")) && b.Size > 32 {
 		return ".tar.gz"
+	} else if strings.HasSuffix(b.MediaType, "tar+zstd") {
+		return ".tar.zst"
 	} else if strings.HasSuffix(b.MediaType, "tar") {
 		return ".tar"
 	} else if strings.HasSuffix(b.MediaType, "json") {
@@ -5,7 +5,11 @@ import (
 	"fmt"
 	"path/filepath"
 	"strconv"
+	"strings"
 	"time"
+
+	"github.com/containers/image/v5/pkg/blobinfocache/memory"
+	"github.com/containers/image/v5/types"
 )
 
 type TaskContext struct {
@@ -33,6 +37,18 @@ type TaskContext struct {
 	CancelFunc   context.CancelFunc
 	Notify       Notify
 	DockerTarget string
+	BlobCache    types.BlobInfoCache
+	Inflight     *InflightBlobs
+	Converted    *ConvertedBlobs
+	reports      []*Report
+	// the budget of the concurrent blob streams shared by the tasks
+	streamChan chan int
+}
+
+// Report is a section of the final report of a run
+type Report struct {
+	Title string
+	Lines []string
 }
 
 func NewTaskContext(log CtxLogger, lc *LocalCache, lt *LocalTemp) *TaskContext {
@@ -106,7 +122,84 @@ func (t *TaskContext) Reset() {
 	t.TarWriter = nil
 	t.CompMeta = nil
 	t.SquashfsTar = nil
-	t.Context, t.CancelFunc = context.WithCancel(context.Background())
+	t.BlobCache = memory.New()
+	t.Inflight = NewInflightBlobs()
+	t.Converted = NewConvertedBlobs()
+	t.reports = nil
+	t.Context, t.CancelFunc = context.WithCancel(WithRangeSupport(context.Background()))
+}
+
+// SetMaxStreams limits the concurrent blob streams of all the tasks, the images transfer their layers in parallel within it
+func (t *TaskContext) SetMaxStreams(n int) {
+	if n > 0 {
+		t.streamChan = make(chan int, n)
+	}
+}
+
+// MaxStreams returns the budget of the concurrent blob streams
+func (t *TaskContext) MaxStreams() int {
+	if t.streamChan == nil {
+		return 1
+	}
+	return cap(t.streamChan)
+}
+
+// AcquireStream blocks until a blob stream is allowed, returns false if the run is cancelled
+func (t *TaskContext) AcquireStream() bool {
+	if t.streamChan == nil {
+		return true
+	}
+	select {
+	case t.streamChan <- 1:
+		return true
+	case <-t.Context.Done():
+		return false
+	}
+}
+
+// ReleaseStream returns the blob stream to the budget
+func (t *TaskContext) ReleaseStream() {
+	if t.streamChan != nil {
+		<-t.streamChan
+	}
+}
+
+// Report records a line under the title for the final report, the duplicated lines are ignored
+func (t *TaskContext) Report(title string, line string) {
+	t.statChan <- 1
+	defer func() {
+		<-t.statChan
+	}()
+	for _, r := range t.reports {
+		if r.Title == title {
+			for _, l := range r.Lines {
+				if l == line {
+					return
+				}
+			}
+			r.Lines = append(r.Lines, line)
+			return
+		}
+	}
+	t.reports = append(t.reports, &Report{Title: title, Lines: []string{line}})
+}
+
+// TakeReports returns the recorded reports and clears them
+func (t *TaskContext) TakeReports() []*Report {
+	t.statChan <- 1
+	defer func() {
+		<-t.statChan
+	}()
+	reports := t.reports
+	t.reports = nil
+	return reports
+}
+
+// PrintReports prints the recorded reports and clears them
+func (t *TaskContext) PrintReports() {
+	for _, r := range t.TakeReports() {
+		t.Info(r.Title + ":\r\n" + strings.Join(r.Lines, "\r\n"))
+	}
 }
 
 func (t *TaskContext) CloseTarWriter() {
@@ -4,9 +4,15 @@ import (
 	"context"
 	"fmt"
 	"io"
+	"io/ioutil"
+	"net/http"
+	"strings"
 
 	"github.com/containers/image/v5/docker"
+	"github.com/containers/image/v5/docker/reference"
+	"github.com/containers/image/v5/manifest"
 	"github.com/containers/image/v5/types"
+	"github.com/opencontainers/go-digest"
 )
 
 // ImageDestination ids a reference of a remote image we will push to
@@ -15,6 +21,19 @@ type ImageDestination struct {
 	destination    types.ImageDestination
 	ctx            context.Context
 	sysctx         *types.SystemContext
+	// blobCache records the repositories where the blobs are known to exist, used by cross repository blob mount
+	blobCache types.BlobInfoCache
+	client    *RegistryClient
+	// blobs are uploaded by chunks if the size is set
+	chunkSize int64
+	// the rate limit of the repo
+	limiter *RateLimiter
+	// the overwrite policy of an existing tag
+	overwrite string
+	// the compression the layers are converted to, empty to keep the original
+	recompress string
+	// the schema1 policy of the legacy images
+	schema1 string
 
 	// destinate image description
 	registry   string
@@ -23,8 +42,8 @@ type ImageDestination struct {
 }
 
 // NewImageDestination generates a ImageDestination by repository, the repository string must include "tag".
-// If username or password ids empty, access to repository will be anonymous.
-func NewImageDestination(pCtx context.Context, registry, repository, tag, username, password string, insecure bool) (*ImageDestination, error) {
+// The credentials are resolved by GetCredentials, access to repository will be anonymous if nothing found.
+func NewImageDestination(pCtx context.Context, registry, repository, tag string, repo *Repo, insecure bool) (*ImageDestination, error) {
 	if CheckIfIncludeTag(repository) {
 		return nil, fmt.Errorf("repository string should not include tag")
 	}
@@ -41,22 +60,24 @@ func NewImageDestination(pCtx context.Context, registry, repository, tag, userna
 		return nil, err
 	}
 
-	var sysctx *types.SystemContext
-	if insecure {
-		// destinatoin registry ids http service
-		sysctx = &types.SystemContext{
-			DockerInsecureSkipTLSVerify: types.OptionalBoolTrue,
-		}
-	} else {
-		sysctx = &types.SystemContext{}
+	ctx := context.WithValue(pCtx, interface{}("ImageDestination"), repository)
+	username, password, err := GetCredentials(repo, registry)
+	if err != nil {
+		return nil, err
 	}
 
-	ctx := context.WithValue(pCtx, interface{}("ImageDestination"), repository)
-	if username != "" && password != "" {
-		sysctx.DockerAuthConfig = &types.DockerAuthConfig{
-			Username: username,
-			Password: password,
-		}
+	insecure = RepoInsecure(repo, insecure)
+	sysctx, err := NewSystemContext(repo, username, password, insecure)
+	if err != nil {
+		return nil, err
+	}
+	tlsConfig, err := NewTLSConfig(repo, insecure)
+	if err != nil {
+		return nil, err
+	}
+	upstream, err := RepoProxy(repo)
+	if err != nil {
+		return nil, err
 	}
 
 	rawDestination, err := destRef.NewImageDestination(ctx, sysctx)
@@ -64,35 +85,151 @@ func NewImageDestination(pCtx context.Context, registry, repository, tag, userna
 		return nil, err
 	}
 
+	var chunkSize int64
+	var overwrite, recompress, schema1 string
+	if repo != nil {
+		if repo.ChunkSize > 0 {
+			chunkSize = int64(repo.ChunkSize) * 1024 * 1024
+		}
+		if err := checkOverwritePolicy(repo.Overwrite); err != nil {
+			return nil, err
+		}
+		overwrite = repo.Overwrite
+		if err := checkRecompress(repo.Recompress); err != nil {
+			return nil, err
+		}
+		recompress = repo.Recompress
+		if err := checkSchema1Policy(repo.Schema1); err != nil {
+			return nil, err
+		}
+		schema1 = repo.Schema1
+	}
+
 	return &ImageDestination{
 		destinationRef: destRef,
 		destination:    rawDestination,
 		ctx:            ctx,
 		sysctx:         sysctx,
+		blobCache:      NoCache,
+		client:         NewRegistryClient(registry, username, password, insecure, tlsConfig, upstream),
+		chunkSize:      chunkSize,
+		limiter:        RepoRateLimiter(repo),
+		overwrite:      overwrite,
+		recompress:     recompress,
+		schema1:        schema1,
 		registry:       registry,
 		repository:     repository,
 		tag:            tag,
 	}, nil
 }
 
-// PushManifest push a manifest file to destinate image
+// PushManifest push a manifest file to destinate image, the overwrite policy should be checked by CheckOverwrite
+// before the blobs are transferred
 func (i *ImageDestination) PushManifest(manifestByte []byte) error {
 	return i.destination.PutManifest(i.ctx, manifestByte, nil)
 }
 
-// PutABlob push a blob to destinate image
+// PushSubManifest push a platform specified manifest of a manifest list by its digest
+func (i *ImageDestination) PushSubManifest(manifestByte []byte, manifestDigest digest.Digest) error {
+	return i.destination.PutManifest(i.ctx, manifestByte, &manifestDigest)
+}
+
+// PutABlob push a blob to destinate image, the blob is uploaded by chunks if the chunk size is set
 func (i *ImageDestination) PutABlob(blob io.ReadCloser, blobInfo types.BlobInfo) error {
+	// io.ReadCloser need to be close
+	defer blob.Close()
+
+	if i.chunkSize > 0 {
+		if err := i.client.PutBlobChunked(i.ctx, i.repository, blob, blobInfo.Digest, i.chunkSize); err != nil {
+			return err
+		}
+		i.recordBlob(blobInfo.Digest)
+		return nil
+	}
+
 	_, err := i.destination.PutBlob(i.ctx, blob, types.BlobInfo{
 		Digest: blobInfo.Digest,
 		Size:   blobInfo.Size,
-	}, NoCache, true)
-
-	// io.ReadCloser need to be close
-	defer blob.Close()
+	}, i.blobCache, true)
 
 	return err
 }
 
+// GetManifestDigest returns the digest of the manifest of the tag, an empty digest is returned if the tag does not exist
+func (i *ImageDestination) GetManifestDigest() (digest.Digest, error) {
+	tag := i.tag
+	if tag == "" {
+		tag = "latest"
+	}
+	return i.GetTagDigest(tag)
+}
+
+// GetTagDigest returns the digest of the manifest of a tag in the repository, empty if the tag does not exist
+func (i *ImageDestination) GetTagDigest(tag string) (digest.Digest, error) {
+	header := http.Header{}
+	header.Set("Accept", strings.Join(manifest.DefaultRequestedManifestMIMETypes, ", "))
+	resp, err := i.client.Do(i.ctx, http.MethodHead, "/v2/"+i.repository+"/manifests/"+tag, "repository:"+i.repository+":pull", header, nil)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	switch resp.StatusCode {
+	case http.StatusOK:
+		if d := resp.Header.Get("Docker-Content-Digest"); d != "" {
+			return digest.Parse(d)
+		}
+		return i.getTagDigestByManifest(tag)
+	case http.StatusNotFound:
+		return "", nil
+	default:
+		return "", NewRegistryError(resp)
+	}
+}
+
+// getTagDigestByManifest gets the manifest of a tag and computes its digest, for the registries sending no
+// "Docker-Content-Digest" header
+func (i *ImageDestination) getTagDigestByManifest(tag string) (digest.Digest, error) {
+	header := http.Header{}
+	header.Set("Accept", strings.Join(manifest.DefaultRequestedManifestMIMETypes, ", "))
+	resp, err := i.client.Do(i.ctx, http.MethodGet, "/v2/"+i.repository+"/manifests/"+tag, "repository:"+i.repository+":pull", header, nil)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	switch resp.StatusCode {
+	case http.StatusOK:
+		manifestByte, err := ioutil.ReadAll(resp.Body)
+		if err != nil {
+			return "", err
+		}
+		return manifest.Digest(manifestByte)
+	case http.StatusNotFound:
+		return "", nil
+	default:
+		return "", NewRegistryError(resp)
+	}
+}
+
+// GetTags gets all the tags of the destination repository
+func (i *ImageDestination) GetTags() ([]string, error) {
+	return i.client.GetTags(i.ctx, i.repository)
+}
+
+// DeleteManifest deletes a manifest of the repository by digest, all the tags of the manifest are deleted with it
+func (i *ImageDestination) DeleteManifest(d digest.Digest) error {
+	resp, err := i.client.Do(i.ctx, http.MethodDelete, "/v2/"+i.repository+"/manifests/"+d.String(), "repository:"+i.repository+":delete", nil, nil)
+	if err != nil {
+		return err
+	}
+	switch resp.StatusCode {
+	case http.StatusOK, http.StatusAccepted:
+		resp.Body.Close()
+		return nil
+	default:
+		return NewRegistryError(resp)
+	}
+}
+
 // CheckBlobExist checks if a blob exist for destination and reuse exist blobs
 func (i *ImageDestination) CheckBlobExist(blobInfo types.BlobInfo) (bool, error) {
 	exist, _, err := i.destination.TryReusingBlob(i.ctx, types.BlobInfo{
@@ -100,9 +237,52 @@ func (i *ImageDestination) CheckBlobExist(blobInfo types.BlobInfo) (bool, error)
 		Size:   blobInfo.Size,
 	}, NoCache, false)
 
+	if exist {
+		i.recordBlob(blobInfo.Digest)
+	}
 	return exist, err
 }
 
+// MountBlob tries to mount a blob from the other repositories of the destination registry which have been
+// known to own the blob during the run, returns the candidate repositories and if the blob is mounted
+func (i *ImageDestination) MountBlob(blobInfo types.BlobInfo) ([]string, bool, error) {
+	var repos []string
+	for _, c := range i.blobCache.CandidateLocations(i.destinationRef.Transport(), i.transportScope(), blobInfo.Digest, false) {
+		if c.Location.Opaque != i.destinationRef.DockerReference().Name() {
+			repos = append(repos, c.Location.Opaque)
+		}
+	}
+	if len(repos) == 0 {
+		return nil, false, nil
+	}
+
+	// docker destination tries "POST /v2/<name>/blobs/uploads/?mount=<digest>&from=<repository>" with the candidates
+	exist, _, err := i.destination.TryReusingBlob(i.ctx, types.BlobInfo{
+		Digest: blobInfo.Digest,
+		Size:   blobInfo.Size,
+	}, i.blobCache, false)
+
+	return repos, exist, err
+}
+
+// SetBlobCache shares a blob info cache among the tasks of a run
+func (i *ImageDestination) SetBlobCache(cache types.BlobInfoCache) {
+	if cache != nil {
+		i.blobCache = cache
+	}
+}
+
+// recordBlob records the blob exists in the repository
+func (i *ImageDestination) recordBlob(d digest.Digest) {
+	i.blobCache.RecordKnownLocation(i.destinationRef.Transport(), i.transportScope(), d,
+		types.BICLocationReference{Opaque: i.destinationRef.DockerReference().Name()})
+}
+
+// blobs can be mounted across the whole registry
+func (i *ImageDestination) transportScope() types.BICTransportScope {
+	return types.BICTransportScope{Opaque: reference.Domain(i.destinationRef.DockerReference())}
+}
+
 // Close a ImageDestination
 func (i *ImageDestination) Close() error {
 	return i.destination.Close()
@@ -122,3 +302,8 @@ func (i *ImageDestination) GetRepository() string {
 func (i *ImageDestination) GetTag() string {
 	return i.tag
 }
+
+// GetRateLimiter returns the rate limiter of the repo, may be nil
+func (i *ImageDestination) GetRateLimiter() *RateLimiter {
+	return i.limiter
+}
@@ -0,0 +1,382 @@
+package core
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"text/tabwriter"
+	"time"
+)
+
+// the results of a diagnostic check
+const (
+	CHECK_PASS = "PASS"
+	CHECK_FAIL = "FAIL"
+	CHECK_SKIP = "SKIP"
+)
+
+var (
+	// DOCTOR_SCRATCH is the repository to test the permissions, under the "repository" of the repo if configured
+	DOCTOR_SCRATCH = "image-transmit-doctor"
+	// DOCTOR_TIMEOUT limits each check
+	DOCTOR_TIMEOUT = 30 * time.Second
+)
+
+// DoctorCheck is the result of a check of a repo
+type DoctorCheck struct {
+	Repo   string
+	Check  string
+	Result string
+	Detail string
+}
+
+// Doctor diagnoses the repos step by step: the DNS, the TLS handshake, the registry API, the authentication and the
+// permissions, so that the cause of a failed transmit is found quickly. The push permission is tested by starting
+// an upload session in the scratch repository which is cancelled at once, nothing is written.
+type Doctor struct {
+	ctx    *TaskContext
+	checks []DoctorCheck
+	failed int
+}
+
+// NewDoctor creates a Doctor
+func NewDoctor(ctx *TaskContext) *Doctor {
+	return &Doctor{
+		ctx: ctx,
+	}
+}
+
+// Diagnose checks a repo, the push permission is checked for the targets only, the rest checks are skipped
+// once the registry is not reachable
+func (d *Doctor) Diagnose(repo *Repo, target bool) {
+	name := repo.Name
+	if name == "" {
+		name = repo.Registry
+	}
+	host := registryHost(repo.Registry)
+	insecure := RepoInsecure(repo, InsecureTarget(repo.Registry))
+	d.ctx.Info(I18n.Sprintf("Diagnose %s(%s)", name, host))
+
+	// same as the RegistryClient
+	endpoint := host
+	if host == "docker.io" || host == "index.docker.io" {
+		endpoint = "registry-1.docker.io"
+	}
+	upstream := doctorProxy(repo, endpoint)
+
+	d.checkDNS(name, endpoint, upstream)
+	d.checkTLS(name, repo, endpoint, insecure, upstream)
+
+	client, challenge, ok := d.checkAPI(name, repo, host, insecure, upstream)
+	if ok {
+		ok = d.checkAuth(name, client, challenge)
+	}
+
+	scratch := DOCTOR_SCRATCH
+	if repo.Repository != "" {
+		scratch = strings.Trim(repo.Repository, "/") + "/" + DOCTOR_SCRATCH
+	}
+	if ok {
+		d.checkPull(name, client, scratch)
+	} else {
+		d.add(name, I18n.Sprintf("Pull"), CHECK_SKIP, I18n.Sprintf("The registry is not reachable"))
+	}
+	if !target {
+		d.add(name, I18n.Sprintf("Push"), CHECK_SKIP, I18n.Sprintf("Source repository"))
+	} else if ok {
+		d.checkPush(name, client, scratch)
+	} else {
+		d.add(name, I18n.Sprintf("Push"), CHECK_SKIP, I18n.Sprintf("The registry is not reachable"))
+	}
+}
+
+func (d *Doctor) checkDNS(name string, host string, upstream *url.URL) {
+	hostname := stripPort(host)
+	if net.ParseIP(hostname) != nil {
+		d.add(name, "DNS", CHECK_PASS, I18n.Sprintf("IP address %s", hostname))
+		return
+	}
+	ctx, cancel := context.WithTimeout(d.ctx.Context, DOCTOR_TIMEOUT)
+	defer cancel()
+	addrs, err := net.DefaultResolver.LookupHost(ctx, hostname)
+	if err != nil {
+		// the proxy may resolve the names which the local DNS does not know
+		if upstream != nil {
+			d.add(name, "DNS", CHECK_SKIP, I18n.Sprintf("%v, resolved by the proxy %s", err, redactProxy(upstream)))
+		} else {
+			d.add(name, "DNS", CHECK_FAIL, err.Error())
+		}
+		return
+	}
+	d.add(name, "DNS", CHECK_PASS, strings.Join(addrs, ","))
+}
+
+func (d *Doctor) checkTLS(name string, repo *Repo, host string, insecure bool, upstream *url.URL) {
+	if strings.HasPrefix(repo.Registry, "http://") {
+		d.add(name, "TLS", CHECK_SKIP, I18n.Sprintf("The registry is served by http"))
+		return
+	}
+	tlsConfig, err := NewTLSConfig(repo, false)
+	if err != nil {
+		d.add(name, "TLS", CHECK_FAIL, err.Error())
+		return
+	}
+
+	addr := host
+	if _, _, err := net.SplitHostPort(host); err != nil {
+		addr = net.JoinHostPort(host, "443")
+	}
+	via := ""
+	if upstream != nil {
+		via = I18n.Sprintf(" via %s", redactProxy(upstream))
+	}
+
+	// the handshake is made by a transport of the proxy like the RegistryClient, the chain is verified after
+	// the handshake, so that it is printed even if untrusted
+	hostname := stripPort(host)
+	transport := &http.Transport{
+		Proxy: http.ProxyURL(upstream),
+		TLSClientConfig: &tls.Config{
+			ServerName:         hostname,
+			InsecureSkipVerify: true,
+			Certificates:       tlsConfig.Certificates,
+		},
+		DisableKeepAlives: true,
+	}
+	ctx, cancel := context.WithTimeout(d.ctx.Context, DOCTOR_TIMEOUT)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, http.MethodHead, "https://"+addr+"/v2/", nil)
+	if err != nil {
+		d.add(name, "TLS", CHECK_FAIL, err.Error())
+		return
+	}
+	resp, err := transport.RoundTrip(req)
+	if err != nil || resp.TLS == nil {
+		if err == nil {
+			resp.Body.Close()
+			err = fmt.Errorf("no tls connection")
+		}
+		if insecure {
+			d.add(name, "TLS", CHECK_SKIP, I18n.Sprintf("Handshake with %s%s failed: %v, http may be used for the insecure registry", addr, via, err))
+		} else {
+			d.add(name, "TLS", CHECK_FAIL, I18n.Sprintf("Handshake with %s%s failed: %v", addr, via, err))
+		}
+		return
+	}
+	resp.Body.Close()
+
+	certs := resp.TLS.PeerCertificates
+	var sb strings.Builder
+	for i, c := range certs {
+		sb.WriteString(fmt.Sprintf("\n  [%v] %s", i, I18n.Sprintf("subject: %s, issuer: %s, expires: %s", c.Subject, c.Issuer, c.NotAfter.Format("2006-01-02"))))
+	}
+	d.ctx.Info(I18n.Sprintf("Certificate chain of %s:%s", addr, sb.String()))
+	if len(certs) == 0 {
+		d.add(name, "TLS", CHECK_FAIL, I18n.Sprintf("No certificate presented by %s", addr))
+		return
+	}
+
+	intermediates := x509.NewCertPool()
+	for _, c := range certs[1:] {
+		intermediates.AddCert(c)
+	}
+	_, err = certs[0].Verify(x509.VerifyOptions{
+		DNSName:       hostname,
+		Roots:         tlsConfig.RootCAs,
+		Intermediates: intermediates,
+	})
+	expires := I18n.Sprintf("expires %s", certs[0].NotAfter.Format("2006-01-02"))
+	switch {
+	case err == nil:
+		d.add(name, "TLS", CHECK_PASS, I18n.Sprintf("Verified%s, %s", via, expires))
+	case insecure:
+		d.add(name, "TLS", CHECK_PASS, I18n.Sprintf("%v, ignored by skiptlsverify, %s", err, expires))
+	default:
+		d.add(name, "TLS", CHECK_FAIL, I18n.Sprintf("%v, configure the cacert or skiptlsverify", err))
+	}
+}
+
+// checkAPI probes "/v2/" without the credentials, the challenge of the authentication is returned
+func (d *Doctor) checkAPI(name string, repo *Repo, host string, insecure bool, upstream *url.URL) (*RegistryClient, string, bool) {
+	tlsConfig, err := NewTLSConfig(repo, insecure)
+	if err != nil {
+		d.add(name, "API", CHECK_FAIL, err.Error())
+		return nil, "", false
+	}
+	username, password, err := GetCredentials(repo, host)
+	if err != nil {
+		d.add(name, "API", CHECK_FAIL, err.Error())
+		return nil, "", false
+	}
+	client := NewRegistryClient(host, username, password, insecure, tlsConfig, upstream)
+
+	ctx, cancel := context.WithTimeout(d.ctx.Context, DOCTOR_TIMEOUT)
+	defer cancel()
+	if err := client.detectScheme(ctx); err != nil {
+		d.add(name, "API", CHECK_FAIL, err.Error())
+		return nil, "", false
+	}
+	target := client.scheme + "://" + client.registry + "/v2/"
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, target, nil)
+	if err != nil {
+		d.add(name, "API", CHECK_FAIL, err.Error())
+		return nil, "", false
+	}
+	resp, err := client.client.Do(req)
+	if err != nil {
+		d.add(name, "API", CHECK_FAIL, err.Error())
+		return nil, "", false
+	}
+	defer resp.Body.Close()
+
+	version := resp.Header.Get("Docker-Distribution-API-Version")
+	if version == "" {
+		version = I18n.Sprintf("no API version header")
+	}
+	switch resp.StatusCode {
+	case http.StatusOK, http.StatusUnauthorized:
+		d.add(name, "API", CHECK_PASS, fmt.Sprintf("GET %s %s, %s", target, resp.Status, version))
+		return client, resp.Header.Get("WWW-Authenticate"), true
+	case http.StatusNotFound:
+		d.add(name, "API", CHECK_FAIL, I18n.Sprintf("GET %s %s, the registry v2 API is not supported", target, resp.Status))
+	default:
+		d.add(name, "API", CHECK_FAIL, fmt.Sprintf("GET %s %v", target, NewRegistryError(resp)))
+	}
+	return nil, "", false
+}
+
+// checkAuth negotiates the authentication by the challenge of "/v2/"
+func (d *Doctor) checkAuth(name string, client *RegistryClient, challenge string) bool {
+	if challenge == "" {
+		d.add(name, I18n.Sprintf("Auth"), CHECK_PASS, I18n.Sprintf("No authentication required"))
+		return true
+	}
+	user := client.username
+	if user == "" {
+		user = I18n.Sprintf("anonymous")
+	}
+	authType, params := parseChallenge(challenge)
+	method := authType
+	if authType == "bearer" {
+		method = I18n.Sprintf("bearer token from %s", params["realm"])
+	}
+
+	ctx, cancel := context.WithTimeout(d.ctx.Context, DOCTOR_TIMEOUT)
+	defer cancel()
+	resp, err := client.Do(ctx, http.MethodGet, "/v2/", "", nil, nil)
+	if err != nil {
+		d.add(name, I18n.Sprintf("Auth"), CHECK_FAIL, fmt.Sprintf("%s, %s: %v", method, user, err))
+		return false
+	}
+	if resp.StatusCode != http.StatusOK {
+		d.add(name, I18n.Sprintf("Auth"), CHECK_FAIL, fmt.Sprintf("%s, %s: %v", method, user, NewRegistryError(resp)))
+		return false
+	}
+	resp.Body.Close()
+	d.add(name, I18n.Sprintf("Auth"), CHECK_PASS, fmt.Sprintf("%s, %s", method, user))
+	return true
+}
+
+// checkPull lists the tags of the scratch repository, it is fine if the repository does not exist
+func (d *Doctor) checkPull(name string, client *RegistryClient, scratch string) {
+	ctx, cancel := context.WithTimeout(d.ctx.Context, DOCTOR_TIMEOUT)
+	defer cancel()
+	resp, err := client.Do(ctx, http.MethodGet, "/v2/"+scratch+"/tags/list", "repository:"+scratch+":pull", nil, nil)
+	if err != nil {
+		d.add(name, I18n.Sprintf("Pull"), CHECK_FAIL, fmt.Sprintf("%s: %v", scratch, err))
+		return
+	}
+	switch resp.StatusCode {
+	case http.StatusOK, http.StatusNotFound:
+		resp.Body.Close()
+		d.add(name, I18n.Sprintf("Pull"), CHECK_PASS, fmt.Sprintf("%s: %s", scratch, resp.Status))
+	default:
+		d.add(name, I18n.Sprintf("Pull"), CHECK_FAIL, fmt.Sprintf("%s: %v", scratch, NewRegistryError(resp)))
+	}
+}
+
+// checkPush starts an upload session in the scratch repository and cancels it
+func (d *Doctor) checkPush(name string, client *RegistryClient, scratch string) {
+	ctx, cancel := context.WithTimeout(d.ctx.Context, DOCTOR_TIMEOUT)
+	defer cancel()
+	scope := "repository:" + scratch + ":pull,push"
+	resp, err := client.Do(ctx, http.MethodPost, "/v2/"+scratch+"/blobs/uploads/", scope, nil, nil)
+	if err != nil {
+		d.add(name, I18n.Sprintf("Push"), CHECK_FAIL, fmt.Sprintf("%s: %v", scratch, err))
+		return
+	}
+	if resp.StatusCode != http.StatusAccepted {
+		d.add(name, I18n.Sprintf("Push"), CHECK_FAIL, fmt.Sprintf("%s: %v", scratch, NewRegistryError(resp)))
+		return
+	}
+	resp.Body.Close()
+	d.add(name, I18n.Sprintf("Push"), CHECK_PASS, fmt.Sprintf("%s: %s", scratch, resp.Status))
+
+	if location := resp.Header.Get("Location"); location != "" {
+		resp, err := client.Do(ctx, http.MethodDelete, location, scope, nil, nil)
+		if err != nil {
+			d.ctx.Debug(I18n.Sprintf("Cancel the upload session of %s failed: %v", scratch, err))
+			return
+		}
+		resp.Body.Close()
+	}
+}
+
+func (d *Doctor) add(repo string, check string, result string, detail string) {
+	d.checks = append(d.checks, DoctorCheck{
+		Repo:   repo,
+		Check:  check,
+		Result: result,
+		Detail: detail,
+	})
+	if result == CHECK_FAIL {
+		d.failed++
+	}
+}
+
+// Failed returns the number of the failed checks
+func (d *Doctor) Failed() int {
+	return d.failed
+}
+
+// Print prints the checks in a table
+func (d *Doctor) Print() {
+	var sb strings.Builder
+	w := tabwriter.NewWriter(&sb, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, I18n.Sprintf("REPO\tCHECK\tRESULT\tDETAIL"))
+	for _, c := range d.checks {
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\n", c.Repo, c.Check, c.Result, c.Detail)
+	}
+	w.Flush()
+	d.ctx.Info(I18n.Sprintf("Diagnosis:\n%s", strings.TrimRight(sb.String(), "\n")))
+	d.ctx.Info(I18n.Sprintf("Total %v checks, %v failed", len(d.checks), d.failed))
+}
+
+// registryHost returns the "host[:port]" of the registry in cfg.yaml, which may have the scheme
+func registryHost(registry string) string {
+	host := strings.TrimPrefix(strings.TrimPrefix(registry, "https://"), "http://")
+	if idx := strings.Index(host, "/"); idx >= 0 {
+		host = host[:idx]
+	}
+	return host
+}
+
+// doctorProxy returns the proxy to connect the host, the proxy of the repo or the one of the environment
+func doctorProxy(repo *Repo, host string) *url.URL {
+	if upstream, err := RepoProxy(repo); err == nil && upstream != nil {
+		return upstream
+	}
+	return environmentProxy(&url.URL{Scheme: "https", Host: host})
+}
+
+func stripPort(host string) string {
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		return h
+	}
+	return host
+}
@@ -0,0 +1,255 @@
+package core
+
+import (
+	"context"
+	"io"
+	"math/rand"
+	"net"
+	"net/http"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/containers/image/v5/docker"
+	"github.com/docker/distribution/registry/api/errcode"
+	v2 "github.com/docker/distribution/registry/api/v2"
+	"github.com/docker/distribution/registry/client"
+	"github.com/pkg/errors"
+)
+
+var (
+	// RETRY_BACKOFF is the delay before the first retry, it doubles for each retry up to RETRY_BACKOFF_MAX
+	RETRY_BACKOFF     = 2 * time.Second
+	RETRY_BACKOFF_MAX = 2 * time.Minute
+	// RETRY_AFTER_MAX caps the "Retry-After" of the registry, ex: docker hub may ask for hours
+	RETRY_AFTER_MAX = 10 * time.Minute
+
+	// the docker transport of containers/image reports the unexpected status in these formats
+	statusCodePattern = regexp.MustCompile(`(status code from registry |StatusCode: |HTTP status: )(\d{3})`)
+)
+
+// wrappedError is the message of a task error, the cause is kept for the classification
+type wrappedError struct {
+	msg   string
+	cause error
+}
+
+func (e *wrappedError) Error() string {
+	return e.msg
+}
+
+func (e *wrappedError) Unwrap() error {
+	return e.cause
+}
+
+// WrapError returns an error with the message which already tells the cause, errors.As still finds the cause
+func WrapError(err error, msg string) error {
+	if err == nil {
+		return errors.New(msg)
+	}
+	return &wrappedError{msg: msg, cause: err}
+}
+
+// ShouldFallback checks if the next mirror should be tried for the error: connection errors,
+// 5xx responses or the manifest/blob unknown by the registry
+func ShouldFallback(err error) bool {
+	if err == nil || errors.Is(err, context.Canceled) {
+		return false
+	}
+
+	if status := statusCode(err); status > 0 {
+		return status >= 500 || status == http.StatusNotFound
+	}
+	var netErr net.Error
+	if errors.As(err, &netErr) {
+		return true
+	}
+	if errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) {
+		return true
+	}
+
+	// the errors formatted by text, only the message of the cause is checked
+	msg := rootCause(err).Error()
+	if m := statusCodePattern.FindStringSubmatch(msg); m != nil {
+		return m[2][0] == '5' || m[2] == "404"
+	}
+	for _, s := range []string{"connection refused", "connection reset", "no such host", "i/o timeout"} {
+		if strings.Contains(msg, s) {
+			return true
+		}
+	}
+	return false
+}
+
+// IsPermanentError checks if the error will not go away by retrying: the image does not exist or the access is denied
+func IsPermanentError(err error) bool {
+	if err == nil {
+		return false
+	}
+
+	var overwriteErr *OverwriteError
+	if errors.As(err, &overwriteErr) {
+		return true
+	}
+	var unauthorized docker.ErrUnauthorizedForCredentials
+	if errors.As(err, &unauthorized) {
+		return true
+	}
+
+	var regErr *RegistryError
+	if errors.As(err, &regErr) {
+		switch regErr.StatusCode {
+		case http.StatusUnauthorized, http.StatusForbidden:
+			return true
+		case http.StatusNotFound:
+			// an expired upload session is not permanent
+			return !strings.Contains(strings.ToLower(regErr.Message), "upload")
+		}
+		return false
+	}
+	if status := statusCode(err); status > 0 {
+		switch status {
+		case http.StatusUnauthorized, http.StatusForbidden, http.StatusNotFound:
+			return !isErrorCode(err, v2.ErrorCodeBlobUploadUnknown)
+		}
+		return false
+	}
+
+	// the errors formatted by text, only the message of the cause is checked
+	msg := rootCause(err).Error()
+	lower := strings.ToLower(msg)
+	if m := statusCodePattern.FindStringSubmatch(msg); m != nil {
+		switch m[2] {
+		case "401", "403":
+			return true
+		case "404":
+			return !strings.Contains(lower, "upload")
+		}
+	}
+	for _, s := range []string{"manifest unknown", "name unknown", "unauthorized", "authentication required", "denied", "invalid username/password"} {
+		if strings.Contains(lower, s) {
+			return true
+		}
+	}
+	return false
+}
+
+// statusCode returns the http status of the typed registry errors in the chain, 0 if none
+func statusCode(err error) int {
+	var regErr *RegistryError
+	if errors.As(err, &regErr) {
+		return regErr.StatusCode
+	}
+	var coder errcode.ErrorCoder
+	if errors.As(err, &coder) {
+		return codeStatus(coder)
+	}
+	var codes errcode.Errors
+	if errors.As(err, &codes) {
+		for _, e := range codes {
+			if errors.As(e, &coder) && codeStatus(coder) > 0 {
+				return codeStatus(coder)
+			}
+		}
+	}
+	var responseErr *client.UnexpectedHTTPResponseError
+	if errors.As(err, &responseErr) {
+		return responseErr.StatusCode
+	}
+	if errors.Is(err, docker.ErrTooManyRequests) {
+		return http.StatusTooManyRequests
+	}
+	return 0
+}
+
+// codeStatus returns the http status of the error code, 0 for the codes unknown to the distribution spec
+func codeStatus(coder errcode.ErrorCoder) int {
+	if coder.ErrorCode() == errcode.ErrorCodeUnknown {
+		return 0
+	}
+	return coder.ErrorCode().Descriptor().HTTPStatusCode
+}
+
+// isErrorCode checks if the error code of the registry is in the chain
+func isErrorCode(err error, code errcode.ErrorCode) bool {
+	var coder errcode.ErrorCoder
+	if errors.As(err, &coder) {
+		return coder.ErrorCode() == code
+	}
+	var codes errcode.Errors
+	if errors.As(err, &codes) {
+		for _, e := range codes {
+			if errors.As(e, &coder) && coder.ErrorCode() == code {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// rootCause returns the innermost error of the chain
+func rootCause(err error) error {
+	for {
+		if next := errors.Unwrap(err); next != nil {
+			err = next
+			continue
+		}
+		if c, ok := err.(interface{ Cause() error }); ok && c.Cause() != nil {
+			err = c.Cause()
+			continue
+		}
+		return err
+	}
+}
+
+// RetryAfter returns the delay asked by the registry in the "Retry-After" header, 0 if not found. Only the requests
+// of the RegistryClient(see RegistryError) carry the header, all the pulls are sent by it, the docker transport of
+// containers/image drops it(docker.ErrTooManyRequests), so a 429 of the pushes it sends is retried by the backoff only
+func RetryAfter(err error) time.Duration {
+	var regErr *RegistryError
+	if errors.As(err, &regErr) {
+		return regErr.RetryAfter()
+	}
+	return 0
+}
+
+// RetryBackoff returns the jittered exponential delay before the retry(0 based), the "Retry-After" wins if it is longer
+func RetryBackoff(retry int, retryAfter time.Duration) time.Duration {
+	backoff := RETRY_BACKOFF
+	for i := 0; i < retry && backoff < RETRY_BACKOFF_MAX; i++ {
+		backoff = backoff * 2
+	}
+	if backoff > RETRY_BACKOFF_MAX {
+		backoff = RETRY_BACKOFF_MAX
+	}
+	// full jitter in the upper half, so the workers do not retry at the same time
+	backoff = backoff/2 + time.Duration(rand.Int63n(int64(backoff/2)+1))
+
+	if retryAfter > RETRY_AFTER_MAX {
+		retryAfter = RETRY_AFTER_MAX
+	}
+	if retryAfter > backoff {
+		return retryAfter
+	}
+	return backoff
+}
+
+// parseRetryAfter parses the "Retry-After" header, which is the seconds or a http date
+func parseRetryAfter(value string) time.Duration {
+	if value == "" {
+		return 0
+	}
+	if seconds, err := strconv.Atoi(value); err == nil {
+		if seconds > 0 {
+			return time.Duration(seconds) * time.Second
+		}
+		return 0
+	}
+	if t, err := http.ParseTime(value); err == nil {
+		if d := time.Until(t); d > 0 {
+			return d
+		}
+	}
+	return 0
+}
@@ -15,18 +15,34 @@ var (
 )
 
 type Repo struct {
-	Name       string `yaml:"name,omitempty"`
-	User       string `yaml:"user"`
-	Registry   string `yaml:"registry"`
-	Password   string `yaml:"password"`
-	Repository string `yaml:"repository,omitempty"`
+	Name          string   `yaml:"name,omitempty"`
+	User          string   `yaml:"user"`
+	Registry      string   `yaml:"registry"`
+	Password      string   `yaml:"password"`
+	Repository    string   `yaml:"repository,omitempty"`
+	ChunkSize     int      `yaml:"chunksize,omitempty"`
+	Mirrors       []string `yaml:"mirrors,omitempty"`
+	AuthFile      string   `yaml:"authfile,omitempty"`
+	CACert        string   `yaml:"cacert,omitempty"`
+	ClientCert    string   `yaml:"clientcert,omitempty"`
+	ClientKey     string   `yaml:"clientkey,omitempty"`
+	SkipTlsVerify bool     `yaml:"skiptlsverify,omitempty"`
+	Proxy         string   `yaml:"proxy,omitempty"`
+	RateLimit     float64  `yaml:"ratelimit,omitempty"`
+	Segments      int      `yaml:"segments,omitempty"`
+	SegmentSize   int      `yaml:"segmentsize,omitempty"`
+	Overwrite     string   `yaml:"overwrite,omitempty"`
+	Recompress    string   `yaml:"recompress,omitempty"`
+	Schema1       string   `yaml:"schema1,omitempty"`
 }
 
 type YamlCfg struct {
 	SrcRepos      []Repo           `yaml:"source,omitempty"`
 	DstRepos      []Repo           `yaml:"target,omitempty"`
 	MaxConn       int              `yaml:"maxconn,omitempty"`
+	MaxStreams    int              `yaml:"maxstreams,omitempty"`
 	Retries       int              `yaml:"retries,omitempty"`
+	BlobRetries   int              `yaml:"blobretries,omitempty"`
 	SingleFile    bool             `yaml:"singlefile,omitempty"`
 	DockerFile    bool             `yaml:"dockerfile,omitempty"`
 	Compressor    string           `yaml:"compressor,omitempty"`
@@ -38,6 +54,11 @@ type YamlCfg struct {
 	Interval      int              `yaml:"interval,omitempty"`
 	DingTalk      []DingTalkAccess `yaml:"dingtalk,omitempty"`
 	SkipTlsVerify bool             `yaml:"skiptlsverify,omitempty"`
+	Platforms     []string         `yaml:"platforms,omitempty"`
+	RateLimit     float64          `yaml:"ratelimit,omitempty"`
+	RateSchedule  []RateSchedule   `yaml:"rateschedule,omitempty"`
+	Prune         PruneCfg         `yaml:"prune,omitempty"`
+	Filter        FilterCfg        `yaml:"filter,omitempty"`
 }
 
 func CheckInvalidChar(text string) bool {
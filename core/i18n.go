@@ -77,6 +77,15 @@ func init() {
 	message.SetString(language.Chinese, "Stat data file failed: %v", "统计数据文件信息失败: %v")
 	message.SetString(language.Chinese, "Meta file error", "镜像规格文件错误")
 	message.SetString(language.Chinese, "Parse file failed(version incompatible or file corrupt?): %v", "解析规格文件失败(可能为版本不同或者文件受损，请检查核对)： %v")
+	message.SetString(language.Chinese, "Decrypt secrets in cfg.yaml failed: %v", "解密cfg.yaml中的密文失败: %v")
+	message.SetString(language.Chinese, "Check the proxies in cfg.yaml failed: %v", "检查cfg.yaml中的代理失败: %v")
+	message.SetString(language.Chinese, "            Encrypt mode:        %s encrypt [-cfg=cfg.yaml] [-value=password]\n", "            加密模式:           %s encrypt [-cfg=cfg.yaml] [-value=password]\n")
+	message.SetString(language.Chinese, "The cfg.yaml to encrypt in place, default: cfg.yaml or data/cfg.yaml", "需要原地加密的配置文件，默认为cfg.yaml或data/cfg.yaml")
+	message.SetString(language.Chinese, "The value to encrypt", "需要加密的值，指定后只输出加密结果")
+	message.SetString(language.Chinese, "Encrypt failed: %v", "加密失败: %v")
+	message.SetString(language.Chinese, "Encrypted %v secrets in %s", "已加密 %[2]s 中的 %[1]v 个密文")
+	message.SetString(language.Chinese, "Generated a new secret key file %s, keep it safe or set the key by env %s", "已生成新的密钥文件 %s, 请妥善保管，也可以通过环境变量 %s 指定密钥")
+	message.SetString(language.Chinese, "WARNING: the secret key file %s is in the data dir %s, anyone copying the data dir can decrypt the secrets, move it to %s or set the key by env %s", "警告: 密钥文件 %s 位于数据目录 %s 中，拷贝数据目录的人都可以解密配置中的密文，请移动到 %s 或者通过环境变量 %s 指定密钥")
 	message.SetString(language.Chinese, "Parse cfg.yaml file failed: %v, for instruction visit github.com/wct-devops/image-transmit", "解析cfg.yaml配置文件失败，使用说明可以咨询DevOps团队或者查看github.com/wct-devops/image-transmit")
 	message.SetString(language.Chinese, "Configuration File Error", "配置文件错误")
 	message.SetString(language.Chinese, "Configuration File cfg.yaml incorrect, for instruction visit github.com/wct-devops/image-transmit", "配置文件错误, 使用说明可以咨询DevOps团队或者查看github.com/wct-devops/image-transmit")
@@ -98,7 +107,12 @@ func init() {
 	message.SetString(language.Chinese, "Read file from cache failed: %v", "读取缓存文件失败: %v")
 	//message.SetString(language.Chinese, "Unknown media type: %s",   "不支持的MediaType类型: %s")
 	message.SetString(language.Chinese, "Manifest format error: %v, manifest: %s", "Manifest格式错误: %v, manifest: %s")
+	message.SetString(language.Chinese, "Manifest %v of OS:%s Architecture:%s not found in meta file, please download %s again", "镜像规格文件中缺少 OS:%[2]s Architecture:%[3]s 的manifest %[1]v, 请重新下载 %[4]s")
 	message.SetString(language.Chinese, "Check blob %s(%v) to %s exist error: %v", "检查blob %s(%v)于 %s 是否存在时发生错误: %v ")
+	message.SetString(language.Chinese, "Image %s is served by mirror %s", "镜像 %s 由镜像站 %s 提供")
+	message.SetString(language.Chinese, "Images served by mirrors", "由镜像站提供的镜像")
+	message.SetString(language.Chinese, "Mount blob %s(%v) to %s from %s", "从 %[4]s 挂载blob %[1]s(%[2]v)到 %[3]s")
+	message.SetString(language.Chinese, "Mount blob %s(%v) to %s from %s failed: %v", "从 %[4]s 挂载blob %[1]s(%[2]v)到 %[3]s 失败: %[5]v")
 	message.SetString(language.Chinese, "Blob %s(%v) has been pushed to %s, will not be pulled", "blob %s(%v) 已经存在于 %s,跳过")
 	message.SetString(language.Chinese, "Blob %s size mismatch, size in meta: %v, size in tar: %v", "Blob %s 大小不一致, 记录大小: %v, tar包中实际大小: %v")
 	message.SetString(language.Chinese, "Put blob %s(%v) to %s success", "上传blob %s(%v)到 %s 完成")
@@ -106,6 +120,7 @@ func init() {
 	message.SetString(language.Chinese, "Blob not found in datafiles: %s", "在数据文件中找不到Blob: %s")
 	message.SetString(language.Chinese, "Put manifest to %s error: %v", "上传manifest到 %s 时报错: %v")
 	message.SetString(language.Chinese, "Put manifest to %s", "上传manifest到 %s 完成")
+	message.SetString(language.Chinese, "Put manifest %s to %s", "上传manifest %s 到 %s 完成")
 	message.SetString(language.Chinese, "Failed to get manifest from %s error: %v", "从 %s 获取manifest信息时报错: %v")
 	message.SetString(language.Chinese, "Get manifest from %s", "从 %s 下载manifest完成")
 	message.SetString(language.Chinese, "Get blob info from %s error: %v", "获取 %s Blob信息报错: %v")
@@ -160,6 +175,9 @@ func init() {
 	message.SetString(language.Chinese, "Unsquashfs uncompress End", "Squashfs解压结束")
 	message.SetString(language.Chinese, "Squashfs condition check failed, we need root privilege(run as root or sudo) and squashfs-tools/tar installed\n", "Squashfs条件检查失败，当使用squashfs压缩时需要使用sudo或者root账号运行，并且安装好squashfs-tools和tar工具\n")
 	message.SetString(language.Chinese, "Output filename prefix", "输出压缩文件的前缀")
+	message.SetString(language.Chinese, "Platforms of multi-arch images to keep, ex: linux/amd64,linux/arm64, default: all", "多架构镜像需要保留的平台, 如: linux/amd64,linux/arm64, 默认为全部")
+	message.SetString(language.Chinese, "Global rate limit in MB/s, default: the ratelimit in cfg.yaml", "全局限速, 单位MB/s, 默认为cfg.yaml中的ratelimit")
+	message.SetString(language.Chinese, "Setup the rate limit failed: %v", "配置限速失败: %v")
 	message.SetString(language.Chinese, "WATCH", "守护")
 	message.SetString(language.Chinese, "Fetch tag list failed for %v with error: %v", "获取%v的tag列表失败: %v")
 	message.SetString(language.Chinese, "Speed:^%s/s v%s/s Total:^%s v%s", "速度:上%s/s 下%s/s 传输总量:上%s 下%s")
@@ -170,4 +188,92 @@ func init() {
 	message.SetString(language.Chinese, "Send DingTalk message, text: %v", "发送钉钉通知: %v")
 	message.SetString(language.Chinese, "Watch mode", "守护模式")
 	message.SetString(language.Chinese, "Start Retry failed tasks", "开始重试失败任务")
+	message.SetString(language.Chinese, "Wait %v before retrying %v failed tasks", "等待%v后重试%v个失败任务")
+	message.SetString(language.Chinese, "Task %s failed with a permanent error, will not retry", "任务%s遇到不可恢复的错误，不再重试")
+	message.SetString(language.Chinese, "%s failed after %v attempts", "%s 尝试%v次后失败")
+	message.SetString(language.Chinese, "%s succeeded after %v attempts", "%s 尝试%v次后成功")
+	message.SetString(language.Chinese, "Retry history", "重试记录")
+	message.SetString(language.Chinese, "Blob retries", "镜像层重试记录")
+	message.SetString(language.Chinese, "Image %s is up to date, skipped", "镜像%s已是最新，跳过")
+	message.SetString(language.Chinese, "Images up to date", "已是最新的镜像")
+	message.SetString(language.Chinese, "Get manifest digest of %s failed: %v", "获取%s的manifest摘要失败: %v")
+	message.SetString(language.Chinese, "Blob %s(%v) is being transferred by another task, wait for it", "镜像层%s(%v)正在被其他任务传输，等待其完成")
+	message.SetString(language.Chinese, "%s %s succeeded after %v attempts", "%s %s 尝试%v次后成功")
+	message.SetString(language.Chinese, "%s %s failed after %v attempts", "%s %s 尝试%v次后失败")
+	message.SetString(language.Chinese, "Transfer blob %s(%v) of %s failed: %v, retry %v/%v in %v", "传输%[3]s的镜像层%[1]s(%[2]v)失败: %[4]v, %[7]v后第%[5]v/%[6]v次重试")
+	message.SetString(language.Chinese, "Plan mode, estimate the data to transfer without writing anything", "预演模式, 仅估算需要传输的数据量, 不写入任何数据")
+	message.SetString(language.Chinese, "The json file of the plan, default: plan_<time>.json", "预演结果的json文件, 默认: plan_<时间>.json")
+	message.SetString(language.Chinese, "            Plan mode:           %s -src=nj -lst=img.lst [-dst=gz] [-inc=...] -plan [-planout=plan.json]\n", "            预演模式:           %s -src=nj -lst=img.lst [-dst=gz] [-inc=...] -plan [-planout=plan.json]\n")
+	message.SetString(language.Chinese, "Image %s not found in meta file", "镜像规格文件中缺少镜像%s")
+	message.SetString(language.Chinese, "Manifest %v of OS:%s Architecture:%s not found in meta file", "镜像规格文件中缺少 OS:%[2]s Architecture:%[3]s 的manifest %[1]v")
+	message.SetString(language.Chinese, "STATUS\tBLOBS\tTRANSFER\tTOTAL\tIMAGE", "状态\t镜像层\t待传输\t总大小\t镜像")
+	message.SetString(language.Chinese, "Plan of %s mode:\n%s", "%s模式的预演结果:\n%s")
+	message.SetString(language.Chinese, "Total %v images, %v failed, %s to transfer of %s", "共%v个镜像, %v个失败, 总大小%[4]s, 需传输%[3]s")
+	message.SetString(language.Chinese, "Save the plan failed: %v", "保存预演结果失败: %v")
+	message.SetString(language.Chinese, "Save the plan to %s", "预演结果已保存到%s")
+	message.SetString(language.Chinese, "Mirror mode, prune the destination tags no longer present in the source after transmitting, preview only with -plan", "镜像模式, 传输后删除目标仓库中源仓库已不存在的tag, 配合-plan时只预览")
+	message.SetString(language.Chinese, "Keep the newest N tags by version in the mirror mode instead, default: the prune.keep in cfg.yaml", "镜像模式下改为按版本只保留最新的N个tag, 默认为cfg.yaml中的prune.keep")
+	message.SetString(language.Chinese, "            Mirror mode:         %s -src=nj -lst=img.lst -dst=gz [--watch] -prune [-keep=10] [-plan]\n", "            镜像模式:           %s -src=nj -lst=img.lst -dst=gz [--watch] -prune [-keep=10] [-plan]\n")
+	message.SetString(language.Chinese, "Setup the prune failed: %v", "清理配置错误: %v")
+	message.SetString(language.Chinese, "No tag found in %s, skip pruning %s", "%s中没有tag, 跳过清理%s")
+	message.SetString(language.Chinese, "No tag to prune in %s", "%s中没有需要清理的tag")
+	message.SetString(language.Chinese, "Tag %s shares the manifest %s with the kept tag %s, skipped", "%s与保留的tag %[3]s使用相同的manifest %[2]s, 跳过")
+	message.SetString(language.Chinese, "Prune failed", "清理失败的tag")
+	message.SetString(language.Chinese, "Prune skipped", "跳过清理的tag")
+	message.SetString(language.Chinese, "Tags to prune", "待清理的tag")
+	message.SetString(language.Chinese, "Pruned tags", "已清理的tag")
+	message.SetString(language.Chinese, "Delete %s failed: %v", "删除%s失败: %v")
+	message.SetString(language.Chinese, "Deleted %s", "已删除%s")
+	message.SetString(language.Chinese, "Tag %s points to %s, refused to overwrite with %s by the policy %s", "tag %[1]s已指向%[2]s, 覆盖策略%[4]s拒绝覆盖为%[3]s")
+	message.SetString(language.Chinese, "Refused overwrites", "拒绝覆盖的镜像")
+	message.SetString(language.Chinese, "%s existing: %s, new: %s", "%s 已有: %s, 新的: %s")
+	message.SetString(language.Chinese, "Image %s exists with another manifest, skipped by the overwrite policy", "镜像%s已存在且内容不同, 按覆盖策略跳过")
+	message.SetString(language.Chinese, "Recompress blob %s(%v) to %s %s(%v)", "重新压缩数据块%s(%v)为%s格式%s(%v)")
+	message.SetString(language.Chinese, "Recompress blob %s(%v) to %s failed: %v", "重新压缩数据块%s(%v)并推送到%s失败: %v")
+	message.SetString(language.Chinese, "Diff id of blob %s mismatch, %s in config, %s uncompressed", "数据块%s的diff id不一致, 配置中为%s, 解压后为%s")
+	message.SetString(language.Chinese, "Convert the schema1 manifest of %s to schema2, config %s", "将%s的schema1格式manifest转换为schema2, 配置%s")
+	message.SetString(language.Chinese, "Convert the schema1 manifest of %s failed: %v", "转换%s的schema1格式manifest失败: %v")
+	message.SetString(language.Chinese, "Layer %s(%v) has the diff id %s", "镜像层%s(%v)的diff id为%s")
+	message.SetString(language.Chinese, "The schema1 manifest is refused by %s: %v", "%s拒绝了schema1格式的manifest: %v")
+	message.SetString(language.Chinese, "            Doctor mode:         %s doctor [-repo=gz] [-scratch=library/test]\n", "            诊断模式:           %s doctor [-repo=gz] [-scratch=library/test]\n")
+	message.SetString(language.Chinese, "The repo name to diagnose, default: all the repos in cfg.yaml", "要诊断的仓库名称, 默认为cfg.yaml中的全部仓库")
+	message.SetString(language.Chinese, "The scratch repository to test the permissions, nothing is written", "用于测试权限的临时仓库, 不会写入任何数据")
+	message.SetString(language.Chinese, "Diagnose %s(%s)", "诊断%s(%s)")
+	message.SetString(language.Chinese, "Pull", "拉取")
+	message.SetString(language.Chinese, "Push", "推送")
+	message.SetString(language.Chinese, "Auth", "认证")
+	message.SetString(language.Chinese, "The registry is not reachable", "仓库无法访问")
+	message.SetString(language.Chinese, "Source repository", "源仓库")
+	message.SetString(language.Chinese, "IP address %s", "IP地址%s")
+	message.SetString(language.Chinese, "%v, resolved by the proxy %s", "%v, 由代理%s解析")
+	message.SetString(language.Chinese, "The registry is served by http", "仓库使用http协议")
+	message.SetString(language.Chinese, " via %s", " 经由%s")
+	message.SetString(language.Chinese, "Handshake with %s%s failed: %v, http may be used for the insecure registry", "与%s%s握手失败: %v, 非安全仓库可能使用http协议")
+	message.SetString(language.Chinese, "Handshake with %s%s failed: %v", "与%s%s握手失败: %v")
+	message.SetString(language.Chinese, "subject: %s, issuer: %s, expires: %s", "使用者: %s, 颁发者: %s, 到期: %s")
+	message.SetString(language.Chinese, "Certificate chain of %s:%s", "%s的证书链:%s")
+	message.SetString(language.Chinese, "No certificate presented by %s", "%s没有提供证书")
+	message.SetString(language.Chinese, "expires %s", "%s到期")
+	message.SetString(language.Chinese, "Verified%s, %s", "校验通过%s, %s")
+	message.SetString(language.Chinese, "%v, ignored by skiptlsverify, %s", "%v, 已按skiptlsverify忽略, %s")
+	message.SetString(language.Chinese, "%v, configure the cacert or skiptlsverify", "%v, 请配置cacert或skiptlsverify")
+	message.SetString(language.Chinese, "no API version header", "没有API版本头")
+	message.SetString(language.Chinese, "GET %s %s, the registry v2 API is not supported", "GET %s %s, 不支持registry v2 API")
+	message.SetString(language.Chinese, "No authentication required", "无需认证")
+	message.SetString(language.Chinese, "anonymous", "匿名")
+	message.SetString(language.Chinese, "bearer token from %s", "从%s获取bearer令牌")
+	message.SetString(language.Chinese, "Cancel the upload session of %s failed: %v", "取消%s的上传会话失败: %v")
+	message.SetString(language.Chinese, "REPO\tCHECK\tRESULT\tDETAIL", "仓库\t检查项\t结果\t详情")
+	message.SetString(language.Chinese, "Diagnosis:\n%s", "诊断结果:\n%s")
+	message.SetString(language.Chinese, "Total %v checks, %v failed", "共%v项检查, %v项失败")
+	message.SetString(language.Chinese, "Keep the images(namespace/repository:tag) matching the regular expression, added to the filter.include in cfg.yaml", "保留匹配该正则表达式的镜像(命名空间/仓库名:tag)，追加到cfg.yaml的filter.include中")
+	message.SetString(language.Chinese, "Drop the images(namespace/repository:tag) matching the regular expression, added to the filter.exclude in cfg.yaml", "丢弃匹配该正则表达式的镜像(命名空间/仓库名:tag)，追加到cfg.yaml的filter.exclude中")
+	message.SetString(language.Chinese, "            Project mode:        echo 'project/*' | %s -src=nj -dst=gz [-include=...] [-exclude=...]\n", "            项目模式:           echo 'project/*' | %s -src=nj -dst=gz [-include=...] [-exclude=...]\n")
+	message.SetString(language.Chinese, "Setup the image filter failed: %v", "设置镜像过滤规则失败: %v")
+	message.SetString(language.Chinese, "Expand %s to %v entries", "通配符%s展开为%v个镜像")
+	message.SetString(language.Chinese, "The destination of %s should end with the same wildcard as the source", "%s的目标需要以与源相同的通配符结尾")
+	message.SetString(language.Chinese, "List the repositories of %s failed: %v", "获取%s的仓库列表失败: %v")
+	message.SetString(language.Chinese, "unknown", "未知")
+	message.SetString(language.Chinese, "The sizes of %v images in schema1 are unknown and not counted", "%v个schema1格式镜像的大小未知，未计入总大小")
+	message.SetString(language.Chinese, "List the repositories of %s is denied: %v, the \"_catalog\" API needs an account with the permission of the whole registry(ex: the system admin of Harbor, the robot accounts are refused), or list the repositories by \"project/app:*\" instead", "获取%s的仓库列表被拒绝: %v，\"_catalog\"接口需要拥有整个仓库权限的账号(例如Harbor的系统管理员，机器人账号会被拒绝)，或者改为按\"project/app:*\"逐个列出仓库")
 }
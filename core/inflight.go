@@ -0,0 +1,40 @@
+package core
+
+import (
+	"sync"
+)
+
+// InflightBlobs records the blobs being transferred by the online tasks of a run, like the BlobDoing of
+// CompressionMetadata for the offline downloads, so a layer shared by the images is transferred only once
+type InflightBlobs struct {
+	m     sync.Mutex
+	blobs map[string]chan struct{}
+}
+
+func NewInflightBlobs() *InflightBlobs {
+	return &InflightBlobs{
+		blobs: make(map[string]chan struct{}),
+	}
+}
+
+// BlobStart registers the blob, nil is returned if the caller should transfer it,
+// or a channel which is closed when the transfer of the other task ends
+func (i *InflightBlobs) BlobStart(key string) <-chan struct{} {
+	i.m.Lock()
+	defer i.m.Unlock()
+	if done, ok := i.blobs[key]; ok {
+		return done
+	}
+	i.blobs[key] = make(chan struct{})
+	return nil
+}
+
+// BlobDone wakes up the tasks waiting for the blob, no matter the transfer succeeded or not
+func (i *InflightBlobs) BlobDone(key string) {
+	i.m.Lock()
+	defer i.m.Unlock()
+	if done, ok := i.blobs[key]; ok {
+		close(done)
+		delete(i.blobs, key)
+	}
+}
@@ -0,0 +1,209 @@
+package core
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"strings"
+	"time"
+)
+
+// RateSchedule overrides the global rate limit during a period of the day, ex: "20:00-08:00"
+type RateSchedule struct {
+	Time  string  `yaml:"time"`
+	Limit float64 `yaml:"limit"`
+}
+
+// RateLimiter is a token bucket shared by the blob readers, the limit is in bytes per second and 0 means unlimited
+type RateLimiter struct {
+	limit     float64
+	schedules []rateSchedule
+	tokens    float64
+	last      time.Time
+	rateChan  chan int
+}
+
+type rateSchedule struct {
+	begin time.Duration
+	end   time.Duration
+	limit float64
+}
+
+// RateLimitReader waits for the tokens of the limiters before returning the data
+type RateLimitReader struct {
+	ctx      context.Context
+	reader   io.ReadCloser
+	limiters []*RateLimiter
+}
+
+var (
+	globalLimiter *RateLimiter
+	repoLimiters  = make(map[string]*RateLimiter)
+	limiterChan   = make(chan int, 1)
+)
+
+// SetupRateLimit creates the global rate limiter by the "ratelimit" and "rateschedule" in cfg.yaml
+func SetupRateLimit(c *YamlCfg) error {
+	l, err := NewRateLimiter(c.RateLimit, c.RateSchedule)
+	if err != nil {
+		return err
+	}
+	limiterChan <- 1
+	globalLimiter = l
+	<-limiterChan
+	return nil
+}
+
+// NewRateLimiter creates a RateLimiter, the limits are in MB per second
+func NewRateLimiter(limit float64, schedules []RateSchedule) (*RateLimiter, error) {
+	l := &RateLimiter{
+		limit:    limit * 1024 * 1024,
+		last:     time.Now(),
+		rateChan: make(chan int, 1),
+	}
+	for _, s := range schedules {
+		seg := strings.Split(s.Time, "-")
+		if len(seg) != 2 {
+			return nil, fmt.Errorf("invalid rate schedule: %s, should be like 08:00-20:00", s.Time)
+		}
+		begin, err := parseDayTime(seg[0])
+		if err != nil {
+			return nil, err
+		}
+		end, err := parseDayTime(seg[1])
+		if err != nil {
+			return nil, err
+		}
+		l.schedules = append(l.schedules, rateSchedule{begin: begin, end: end, limit: s.Limit * 1024 * 1024})
+	}
+	return l, nil
+}
+
+// RepoRateLimiter returns the rate limiter of the repo, nil if the repo has no limit
+func RepoRateLimiter(repo *Repo) *RateLimiter {
+	if repo == nil || repo.RateLimit <= 0 {
+		return nil
+	}
+	key := repo.Name + "|" + repo.Registry
+	limiterChan <- 1
+	defer func() { <-limiterChan }()
+	if l, ok := repoLimiters[key]; ok {
+		return l
+	}
+	l, _ := NewRateLimiter(repo.RateLimit, nil)
+	repoLimiters[key] = l
+	return l
+}
+
+// NewRateLimitReader wraps the reader with the global rate limiter and the given ones, the nil limiters are ignored
+func NewRateLimitReader(ctx context.Context, reader io.ReadCloser, limiters ...*RateLimiter) io.ReadCloser {
+	limiterChan <- 1
+	all := []*RateLimiter{globalLimiter}
+	<-limiterChan
+
+	r := &RateLimitReader{ctx: ctx, reader: reader}
+	for _, l := range append(all, limiters...) {
+		if l != nil && l.active() {
+			r.limiters = append(r.limiters, l)
+		}
+	}
+	if len(r.limiters) == 0 {
+		return reader
+	}
+	return r
+}
+
+func (r *RateLimitReader) Read(p []byte) (int, error) {
+	// read a small piece each time to make the speed smooth
+	if len(p) > 32*1024 {
+		p = p[:32*1024]
+	}
+	n, err := r.reader.Read(p)
+	if n > 0 {
+		for _, l := range r.limiters {
+			if werr := l.Wait(r.ctx, n); werr != nil {
+				return n, werr
+			}
+		}
+	}
+	return n, err
+}
+
+func (r *RateLimitReader) Close() error {
+	return r.reader.Close()
+}
+
+// Wait blocks until n bytes are allowed
+func (l *RateLimiter) Wait(ctx context.Context, n int) error {
+	l.rateChan <- 1
+	now := time.Now()
+	limit := l.current(now)
+	if limit <= 0 {
+		l.tokens = 0
+		l.last = now
+		<-l.rateChan
+		return nil
+	}
+	// the burst is the data of one second
+	l.tokens = l.tokens + now.Sub(l.last).Seconds()*limit
+	if l.tokens > limit {
+		l.tokens = limit
+	}
+	l.last = now
+	l.tokens = l.tokens - float64(n)
+	var wait time.Duration
+	if l.tokens < 0 {
+		wait = time.Duration(-l.tokens / limit * float64(time.Second))
+	}
+	<-l.rateChan
+
+	if wait <= 0 {
+		return nil
+	}
+	timer := time.NewTimer(wait)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// active checks if the limiter may limit the speed at any time
+func (l *RateLimiter) active() bool {
+	if l.limit > 0 {
+		return true
+	}
+	for _, s := range l.schedules {
+		if s.limit > 0 {
+			return true
+		}
+	}
+	return false
+}
+
+// current returns the limit at the time, the first matched schedule wins
+func (l *RateLimiter) current(now time.Time) float64 {
+	offset := time.Duration(now.Hour())*time.Hour + time.Duration(now.Minute())*time.Minute + time.Duration(now.Second())*time.Second
+	for _, s := range l.schedules {
+		if s.begin <= s.end {
+			if offset >= s.begin && offset < s.end {
+				return s.limit
+			}
+		} else if offset >= s.begin || offset < s.end {
+			// crosses the midnight
+			return s.limit
+		}
+	}
+	return l.limit
+}
+
+// parseDayTime parses "HH:MM" to the offset of the day
+func parseDayTime(s string) (time.Duration, error) {
+	t, err := time.Parse("15:04", strings.TrimSpace(s))
+	if err != nil {
+		return 0, fmt.Errorf("invalid time %s in rate schedule, should be like 08:00", s)
+	}
+	return time.Duration(t.Hour())*time.Hour + time.Duration(t.Minute())*time.Minute, nil
+}
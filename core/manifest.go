@@ -2,12 +2,25 @@ package core
 
 import (
 	"fmt"
+	"strings"
 
 	"github.com/containers/image/v5/manifest"
+	"github.com/opencontainers/go-digest"
+	imgspecv1 "github.com/opencontainers/image-spec/specs-go/v1"
 )
 
-// ManifestHandler expends the ability of handling manifest list in schema2, but it's not finished yet
-// return the digest array of manifests in the manifest list if exist.
+// ManifestDescriptor describes a platform specified manifest in a manifest list or an OCI image index
+type ManifestDescriptor struct {
+	Digest       digest.Digest
+	MediaType    string
+	Size         int64
+	OS           string
+	Architecture string
+	Variant      string
+}
+
+// ManifestHandler expends the ability of handling manifest list in schema2 and OCI image index,
+// return the manifests of all the platforms in the manifest list if exist.
 func ManifestHandler(m []byte, t string, i *ImageSource) ([]manifest.Manifest, error) {
 
 	var manifestInfoSlice []manifest.Manifest
@@ -19,6 +32,13 @@ func ManifestHandler(m []byte, t string, i *ImageSource) ([]manifest.Manifest, e
 		}
 		manifestInfoSlice = append(manifestInfoSlice, manifestInfo)
 		return manifestInfoSlice, nil
+	} else if t == imgspecv1.MediaTypeImageManifest {
+		manifestInfo, err := manifest.OCI1FromManifest(m)
+		if err != nil {
+			return nil, err
+		}
+		manifestInfoSlice = append(manifestInfoSlice, manifestInfo)
+		return manifestInfoSlice, nil
 	} else if t == manifest.DockerV2Schema1MediaType || t == manifest.DockerV2Schema1SignedMediaType {
 		manifestInfo, err := manifest.Schema1FromManifest(m)
 		if err != nil {
@@ -26,15 +46,15 @@ func ManifestHandler(m []byte, t string, i *ImageSource) ([]manifest.Manifest, e
 		}
 		manifestInfoSlice = append(manifestInfoSlice, manifestInfo)
 		return manifestInfoSlice, nil
-	} else if t == manifest.DockerV2ListMediaType {
-		manifestSchemaListInfo, err := manifest.Schema2ListFromManifest(m)
+	} else if t == manifest.DockerV2ListMediaType || t == imgspecv1.MediaTypeImageIndex {
+		descriptors, err := ManifestListDescriptors(m, t)
 		if err != nil {
 			return nil, err
 		}
 
-		for _, manifestDescriptorElem := range manifestSchemaListInfo.Manifests {
+		for _, manifestDescriptorElem := range descriptors {
 
-			manifestByte, manifestType, err := i.source.GetManifest(i.ctx, &manifestDescriptorElem.Digest)
+			manifestByte, manifestType, err := i.GetSubManifest(manifestDescriptorElem.Digest)
 			if err != nil {
 				return nil, err
 			}
@@ -51,3 +71,141 @@ func ManifestHandler(m []byte, t string, i *ImageSource) ([]manifest.Manifest, e
 
 	return nil, fmt.Errorf("unsupported manifest type: %v", t)
 }
+
+// ManifestListDescriptors returns the platform specified manifests of a schema2 manifest list or an OCI image index
+func ManifestListDescriptors(m []byte, t string) ([]ManifestDescriptor, error) {
+	var descriptors []ManifestDescriptor
+
+	if t == manifest.DockerV2ListMediaType {
+		manifestSchemaListInfo, err := manifest.Schema2ListFromManifest(m)
+		if err != nil {
+			return nil, err
+		}
+		for _, d := range manifestSchemaListInfo.Manifests {
+			descriptors = append(descriptors, ManifestDescriptor{
+				Digest:       d.Digest,
+				MediaType:    d.MediaType,
+				Size:         d.Size,
+				OS:           d.Platform.OS,
+				Architecture: d.Platform.Architecture,
+				Variant:      d.Platform.Variant,
+			})
+		}
+		return descriptors, nil
+	} else if t == imgspecv1.MediaTypeImageIndex {
+		index, err := manifest.OCI1IndexFromManifest(m)
+		if err != nil {
+			return nil, err
+		}
+		for _, d := range index.Manifests {
+			descriptor := ManifestDescriptor{
+				Digest:    d.Digest,
+				MediaType: d.MediaType,
+				Size:      d.Size,
+			}
+			// platform is optional in OCI image index
+			if d.Platform != nil {
+				descriptor.OS = d.Platform.OS
+				descriptor.Architecture = d.Platform.Architecture
+				descriptor.Variant = d.Platform.Variant
+			}
+			descriptors = append(descriptors, descriptor)
+		}
+		return descriptors, nil
+	}
+
+	return nil, fmt.Errorf("unsupported manifest list type: %v", t)
+}
+
+// FilterManifestList prunes the manifest list to the given platforms(os/arch[/variant]), the original
+// manifest list is returned if nothing pruned so that the digest keeps the same. The pruned manifests are returned
+// for logging, including the ones without platform(ex: the attestations in an OCI image index), which match nothing.
+// An error is returned if no manifest matches
+func FilterManifestList(m []byte, t string, platforms []string) ([]byte, []ManifestDescriptor, error) {
+	descriptors, err := ManifestListDescriptors(m, t)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	var kept []int
+	var pruned []ManifestDescriptor
+	for idx, d := range descriptors {
+		matched := false
+		for _, p := range platforms {
+			if MatchPlatform(d, p) {
+				matched = true
+				break
+			}
+		}
+		if matched {
+			kept = append(kept, idx)
+		} else {
+			pruned = append(pruned, d)
+		}
+	}
+
+	if len(pruned) == 0 {
+		return m, nil, nil
+	}
+	if len(kept) == 0 {
+		var available []string
+		for _, d := range descriptors {
+			available = append(available, d.Platform())
+		}
+		return nil, pruned, fmt.Errorf("no manifest matches the platforms %s, the manifest list has: %s", strings.Join(platforms, ","), strings.Join(available, ","))
+	}
+
+	if t == manifest.DockerV2ListMediaType {
+		list, err := manifest.Schema2ListFromManifest(m)
+		if err != nil {
+			return nil, nil, err
+		}
+		var manifests []manifest.Schema2ManifestDescriptor
+		for _, idx := range kept {
+			manifests = append(manifests, list.Manifests[idx])
+		}
+		list.Manifests = manifests
+		b, err := list.Serialize()
+		return b, pruned, err
+	} else {
+		index, err := manifest.OCI1IndexFromManifest(m)
+		if err != nil {
+			return nil, nil, err
+		}
+		var manifests []imgspecv1.Descriptor
+		for _, idx := range kept {
+			manifests = append(manifests, index.Manifests[idx])
+		}
+		index.Manifests = manifests
+		b, err := index.Serialize()
+		return b, pruned, err
+	}
+}
+
+// Platform returns the platform string like linux/arm64/v8, "unknown" if the manifest has no platform
+func (d ManifestDescriptor) Platform() string {
+	if d.OS == "" && d.Architecture == "" {
+		return "unknown"
+	}
+	if d.Variant != "" {
+		return d.OS + "/" + d.Architecture + "/" + d.Variant
+	}
+	return d.OS + "/" + d.Architecture
+}
+
+// MatchPlatform checks if a platform specified manifest matches the platform string like linux/arm64/v8,
+// the variant is ignored if not given
+func MatchPlatform(d ManifestDescriptor, platform string) bool {
+	seg := strings.Split(strings.TrimSpace(platform), "/")
+	if len(seg) < 2 || seg[0] != d.OS || seg[1] != d.Architecture {
+		return false
+	}
+	if len(seg) < 3 {
+		return true
+	}
+	variant := d.Variant
+	if variant == "" && d.Architecture == "arm64" { // arm64 means arm64/v8 by default
+		variant = "v8"
+	}
+	return seg[2] == variant
+}
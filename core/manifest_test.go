@@ -0,0 +1,178 @@
+package core
+
+import (
+	"encoding/json"
+	"reflect"
+	"testing"
+
+	"github.com/containers/image/v5/manifest"
+	"github.com/opencontainers/go-digest"
+	imgspecv1 "github.com/opencontainers/image-spec/specs-go/v1"
+)
+
+func TestMatchPlatform(t *testing.T) {
+	cases := []struct {
+		name     string
+		os       string
+		arch     string
+		variant  string
+		platform string
+		match    bool
+	}{
+		{name: "os and arch", os: "linux", arch: "amd64", platform: "linux/amd64", match: true},
+		{name: "spaces trimmed", os: "linux", arch: "amd64", platform: " linux/amd64 ", match: true},
+		{name: "other arch", os: "linux", arch: "arm64", platform: "linux/amd64"},
+		{name: "other os", os: "windows", arch: "amd64", platform: "linux/amd64"},
+		{name: "variant ignored if not given", os: "linux", arch: "arm", variant: "v7", platform: "linux/arm", match: true},
+		{name: "variant matched", os: "linux", arch: "arm", variant: "v7", platform: "linux/arm/v7", match: true},
+		{name: "other variant", os: "linux", arch: "arm", variant: "v6", platform: "linux/arm/v7"},
+		{name: "variant missing", os: "linux", arch: "arm", platform: "linux/arm/v7"},
+		{name: "arm64 means v8", os: "linux", arch: "arm64", platform: "linux/arm64/v8", match: true},
+		{name: "arm64 explicit v8", os: "linux", arch: "arm64", variant: "v8", platform: "linux/arm64/v8", match: true},
+		{name: "no platform", platform: "linux/amd64"},
+		{name: "os only", os: "linux", arch: "amd64", platform: "linux"},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			d := ManifestDescriptor{OS: c.os, Architecture: c.arch, Variant: c.variant}
+			if got := MatchPlatform(d, c.platform); got != c.match {
+				t.Errorf("expect %v, got %v", c.match, got)
+			}
+		})
+	}
+}
+
+func TestFilterManifestList(t *testing.T) {
+	amd64 := imgspecv1.Descriptor{MediaType: imgspecv1.MediaTypeImageManifest, Digest: digest.FromString("amd64"), Size: 1,
+		Platform: &imgspecv1.Platform{OS: "linux", Architecture: "amd64"}}
+	armv7 := imgspecv1.Descriptor{MediaType: imgspecv1.MediaTypeImageManifest, Digest: digest.FromString("armv7"), Size: 1,
+		Platform: &imgspecv1.Platform{OS: "linux", Architecture: "arm", Variant: "v7"}}
+	arm64 := imgspecv1.Descriptor{MediaType: imgspecv1.MediaTypeImageManifest, Digest: digest.FromString("arm64"), Size: 1,
+		Platform: &imgspecv1.Platform{OS: "linux", Architecture: "arm64"}}
+	attestation := imgspecv1.Descriptor{MediaType: imgspecv1.MediaTypeImageManifest, Digest: digest.FromString("attestation"), Size: 1}
+
+	index := func(descriptors ...imgspecv1.Descriptor) []byte {
+		b, err := manifest.OCI1IndexFromComponents(descriptors, nil).Serialize()
+		if err != nil {
+			t.Fatal(err)
+		}
+		return b
+	}
+	list := func(descriptors ...imgspecv1.Descriptor) []byte {
+		var manifests []manifest.Schema2ManifestDescriptor
+		for _, d := range descriptors {
+			m := manifest.Schema2ManifestDescriptor{Schema2Descriptor: manifest.Schema2Descriptor{
+				MediaType: manifest.DockerV2Schema2MediaType, Digest: d.Digest, Size: d.Size}}
+			if d.Platform != nil {
+				m.Platform = manifest.Schema2PlatformSpec{OS: d.Platform.OS, Architecture: d.Platform.Architecture, Variant: d.Platform.Variant}
+			}
+			manifests = append(manifests, m)
+		}
+		b, err := manifest.Schema2ListFromComponents(manifests).Serialize()
+		if err != nil {
+			t.Fatal(err)
+		}
+		return b
+	}
+
+	cases := []struct {
+		name      string
+		manifest  []byte
+		mediaType string
+		platforms []string
+		kept      []digest.Digest
+		pruned    []string
+		fail      bool
+	}{
+		{
+			name:      "schema2 list by arch",
+			manifest:  list(amd64, armv7, arm64),
+			mediaType: manifest.DockerV2ListMediaType,
+			platforms: []string{"linux/amd64", "linux/arm64"},
+			kept:      []digest.Digest{amd64.Digest, arm64.Digest},
+			pruned:    []string{"linux/arm/v7"},
+		},
+		{
+			name:      "schema2 list by variant",
+			manifest:  list(amd64, armv7, arm64),
+			mediaType: manifest.DockerV2ListMediaType,
+			platforms: []string{"linux/arm/v7", "linux/arm64/v8"},
+			kept:      []digest.Digest{armv7.Digest, arm64.Digest},
+			pruned:    []string{"linux/amd64"},
+		},
+		{
+			name:      "oci index without platform pruned",
+			manifest:  index(amd64, attestation, armv7),
+			mediaType: imgspecv1.MediaTypeImageIndex,
+			platforms: []string{"linux/amd64"},
+			kept:      []digest.Digest{amd64.Digest},
+			pruned:    []string{"unknown", "linux/arm/v7"},
+		},
+		{
+			name:      "all matched",
+			manifest:  index(amd64, arm64),
+			mediaType: imgspecv1.MediaTypeImageIndex,
+			platforms: []string{"linux/amd64", "linux/arm64"},
+			kept:      []digest.Digest{amd64.Digest, arm64.Digest},
+		},
+		{
+			name:      "nothing matched",
+			manifest:  list(amd64, armv7),
+			mediaType: manifest.DockerV2ListMediaType,
+			platforms: []string{"linux/s390x"},
+			pruned:    []string{"linux/amd64", "linux/arm/v7"},
+			fail:      true,
+		},
+		{
+			name:      "oci index without any platform",
+			manifest:  index(attestation),
+			mediaType: imgspecv1.MediaTypeImageIndex,
+			platforms: []string{"linux/amd64"},
+			pruned:    []string{"unknown"},
+			fail:      true,
+		},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			b, pruned, err := FilterManifestList(c.manifest, c.mediaType, c.platforms)
+			var prunedPlatforms []string
+			for _, d := range pruned {
+				prunedPlatforms = append(prunedPlatforms, d.Platform())
+			}
+			if !reflect.DeepEqual(prunedPlatforms, c.pruned) {
+				t.Errorf("expect pruned %v, got %v", c.pruned, prunedPlatforms)
+			}
+			if c.fail {
+				if err == nil {
+					t.Fatalf("expect an error, got %s", b)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(c.pruned) == 0 && string(b) != string(c.manifest) {
+				t.Errorf("expect the original manifest list if nothing pruned, got %s", b)
+			}
+
+			descriptors, err := ManifestListDescriptors(b, c.mediaType)
+			if err != nil {
+				t.Fatal(err)
+			}
+			var kept []digest.Digest
+			for _, d := range descriptors {
+				kept = append(kept, d.Digest)
+			}
+			if !reflect.DeepEqual(kept, c.kept) {
+				t.Errorf("expect kept %v, got %v", c.kept, kept)
+			}
+			var meta struct {
+				MediaType string `json:"mediaType"`
+			}
+			if err := json.Unmarshal(b, &meta); err != nil || (meta.MediaType != "" && meta.MediaType != c.mediaType) {
+				t.Errorf("expect media type %s, got %s %v", c.mediaType, meta.MediaType, err)
+			}
+		})
+	}
+}
@@ -8,10 +8,12 @@ import (
 	"fmt"
 	"io"
 	"io/ioutil"
+	"os"
 	"path/filepath"
 	"time"
 
 	log "github.com/cihub/seelog"
+	"github.com/containers/image/v5/manifest"
 	"github.com/containers/image/v5/types"
 	"github.com/opencontainers/go-digest"
 	"github.com/pkg/errors"
@@ -53,19 +55,32 @@ func (t *OfflineDownTask) Run(tid int) error {
 	defer t.ctx.CompMeta.ClearDoing(tid)
 	manifestByte, manifestType, err := t.is.GetManifest()
 	if err != nil {
-		return errors.New(I18n.Sprintf("Failed to get manifest from %s error: %v", srcUrl, err))
+		return WrapError(err, I18n.Sprintf("Failed to get manifest from %s error: %v", srcUrl, err))
 	}
 	t.ctx.Info(I18n.Sprintf("Get manifest from %s", srcUrl))
+	ReportMirror(t.ctx, t.is, srcUrl)
 
 	blobInfos, err := t.is.GetBlobInfos(manifestByte, manifestType)
 	if err != nil {
-		return errors.New(I18n.Sprintf("Get blob info from %s error: %v", srcUrl, err))
+		return WrapError(err, I18n.Sprintf("Get blob info from %s error: %v", srcUrl, err))
+	}
+	if manifest.MIMETypeIsMultiImage(manifestType) {
+		descriptors, err := ManifestListDescriptors(manifestByte, manifestType)
+		if err != nil {
+			return err
+		}
+		for _, d := range descriptors {
+			subManifestByte, _, err := t.is.GetSubManifest(d.Digest)
+			if err != nil {
+				return WrapError(err, I18n.Sprintf("Get manifest %v of OS:%s Architecture:%s for manifest list error: %v", d.Digest, d.OS, d.Architecture, err))
+			}
+			t.ctx.CompMeta.AddSubManifest(d.Digest.String(), string(subManifestByte))
+		}
 	}
 	t.ctx.CompMeta.AddImage(t.url, string(manifestByte))
 
 	for _, b := range blobInfos {
 		begin := time.Now()
-		var netBytes = b.Size
 		if t.ctx.Cancel() {
 			return errors.New(I18n.Sprintf("User cancelled..."))
 		}
@@ -75,104 +90,124 @@ func (t *OfflineDownTask) Run(tid int) error {
 			continue
 		}
 
-		blob, size, err := t.is.GetABlob(b)
+		var netBytes int64
+		err := RetryBlob(t.ctx, srcUrl, b, func() error {
+			var err error
+			netBytes, err = t.saveBlob(tid, b, srcUrl)
+			return err
+		})
 		if err != nil {
-			return errors.New(I18n.Sprintf("Get blob %s(%v) from %s failed: %v", b.Digest.String(), FormatByteSize(size), srcUrl, err))
+			return err
 		}
-		t.ctx.Debug(I18n.Sprintf("Get a blob %s(%v) from %s success", ShortenString(b.Digest.String(), 19), FormatByteSize(size), srcUrl))
-		blobName := b.Digest.Hex() + GetBlobSuffix(b)
-
-		if t.ctx.SquashfsTar != nil {
-			if t.ctx.Cache != nil {
-				matched, filename := t.ctx.Cache.Match(blobName, size)
-				if !matched {
-					r, w, _ := t.ctx.Cache.SaveStream(blobName, blob)
-					err := t.ctx.SquashfsTar.AppendFileStream(blobName, size, r)
-					w.Close()
-					if err != nil {
-						return errors.New(I18n.Sprintf("Save Stream file to cache failed: %v", err))
-					}
-				} else {
-					blob.Close()
-					r, err := t.ctx.Cache.Reuse(blobName)
-					t.ctx.Debug(I18n.Sprintf("Reuse cache: %s", filename))
-					netBytes = 0
-					if err != nil {
-						return errors.New(I18n.Sprintf("Read file from cache failed: %v", err))
-					}
-					err = t.ctx.SquashfsTar.AppendFileStream(blobName, size, r)
-					if err != nil {
-						return err
-					}
+		if netBytes > 0 {
+			t.ctx.StatDown(netBytes, time.Since(begin))
+		}
+		t.ctx.CompMeta.BlobDone(b.Digest.Hex(), t.url)
+	}
+	return nil
+}
+
+// saveBlob pulls a blob and saves it to the archive, returns the bytes from the network, the unit of the blob level retry
+func (t *OfflineDownTask) saveBlob(tid int, b types.BlobInfo, srcUrl string) (int64, error) {
+	var netBytes = b.Size
+	blob, size, err := t.is.GetABlob(b)
+	if err != nil {
+		return 0, WrapError(err, I18n.Sprintf("Get blob %s(%v) from %s failed: %v", b.Digest.String(), FormatByteSize(size), srcUrl, err))
+	}
+	blob = NewRateLimitReader(t.ctx.Context, blob, t.is.GetRateLimiter())
+	t.ctx.Debug(I18n.Sprintf("Get a blob %s(%v) from %s success", ShortenString(b.Digest.String(), 19), FormatByteSize(size), srcUrl))
+	blobName := b.Digest.Hex() + GetBlobSuffix(b)
+
+	if t.ctx.SquashfsTar != nil {
+		if t.ctx.Cache != nil {
+			matched, filename := t.ctx.Cache.Match(blobName, size)
+			if !matched {
+				r, w, _ := t.ctx.Cache.SaveStream(blobName, blob)
+				err := t.ctx.SquashfsTar.AppendFileStream(blobName, size, r)
+				w.Close()
+				if err != nil {
+					return 0, WrapError(err, I18n.Sprintf("Save Stream file to cache failed: %v", err))
 				}
 			} else {
-				err = t.ctx.SquashfsTar.AppendFileStream(blobName, size, blob)
+				blob.Close()
+				r, err := t.ctx.Cache.Reuse(blobName)
+				t.ctx.Debug(I18n.Sprintf("Reuse cache: %s", filename))
+				netBytes = 0
 				if err != nil {
-					return err
+					return 0, WrapError(err, I18n.Sprintf("Read file from cache failed: %v", err))
 				}
-			}
-		} else if t.ctx.SingleWriter != nil {
-			if t.ctx.Cache != nil {
-				matched, filename := t.ctx.Cache.Match(blobName, size)
-				if !matched {
-					var err error
-					filename, err = t.ctx.Cache.SaveFile(blobName, blob, size)
-					if err != nil {
-						return errors.New(I18n.Sprintf("Save Stream file to cache failed: %v", err))
-					}
-				} else {
-					t.ctx.Debug(I18n.Sprintf("Reuse cache %s", filename))
-					netBytes = 0
-					blob.Close()
-				}
-				t.ctx.SingleWriter.PutFile(filename)
-				t.ctx.Debug(I18n.Sprintf("Put file to archive: %s", filename))
-			} else {
-				filename, err := t.ctx.Temp.SaveFile(blobName, blob, size)
+				err = t.ctx.SquashfsTar.AppendFileStream(blobName, size, r)
 				if err != nil {
-					return errors.New(I18n.Sprintf("Save Stream file to temp failed: %v", err))
+					return 0, err
 				}
-				t.ctx.SingleWriter.PutFile(filename)
-				t.ctx.Debug(I18n.Sprintf("Put file to archive: %s", filename))
 			}
 		} else {
-			tar := t.ctx.TarWriter[tid]
-			defer tar.Flush()
-			if t.ctx.Cache != nil {
-				matched, filename := t.ctx.Cache.Match(blobName, size)
-				if !matched {
-					r, w, _ := t.ctx.Cache.SaveStream(blobName, blob)
-					err = tar.AppendFileStream(blobName, size, r)
-					w.Close()
-					if err != nil {
-						return err
-					}
-				} else {
-					blob.Close()
-					r, err := t.ctx.Cache.Reuse(blobName)
-					t.ctx.Debug(I18n.Sprintf("Reuse cache: %s", filename))
-					netBytes = 0
-					if err != nil {
-						return errors.New(I18n.Sprintf("Read file from cache failed: %v", err))
-					}
-					err = tar.AppendFileStream(blobName, size, r)
-					if err != nil {
-						return err
-					}
+			err = t.ctx.SquashfsTar.AppendFileStream(blobName, size, blob)
+			if err != nil {
+				return 0, err
+			}
+		}
+	} else if t.ctx.SingleWriter != nil {
+		if t.ctx.Cache != nil {
+			matched, filename := t.ctx.Cache.Match(blobName, size)
+			if !matched {
+				var err error
+				filename, err = t.ctx.Cache.SaveFile(blobName, blob, size)
+				if err != nil {
+					return 0, WrapError(err, I18n.Sprintf("Save Stream file to cache failed: %v", err))
 				}
 			} else {
-				err = tar.AppendFileStream(blobName, size, blob)
-				if err != nil {
-					return err
+				t.ctx.Debug(I18n.Sprintf("Reuse cache %s", filename))
+				netBytes = 0
+				blob.Close()
+			}
+			t.ctx.SingleWriter.PutFile(filename)
+			t.ctx.Debug(I18n.Sprintf("Put file to archive: %s", filename))
+		} else {
+			filename, err := t.ctx.Temp.SaveFile(blobName, blob, size)
+			if err != nil {
+				return 0, WrapError(err, I18n.Sprintf("Save Stream file to temp failed: %v", err))
+			}
+			t.ctx.SingleWriter.PutFile(filename)
+			t.ctx.Debug(I18n.Sprintf("Put file to archive: %s", filename))
+		}
+	} else {
+		tar := t.ctx.TarWriter[tid]
+		defer tar.Flush()
+		// the blob is saved to a local file before appended, a broken download must not leave a half written blob in the tar
+		var r io.ReadCloser
+		if t.ctx.Cache != nil {
+			matched, filename := t.ctx.Cache.Match(blobName, size)
+			if !matched {
+				if _, err := t.ctx.Cache.SaveFile(blobName, blob, size); err != nil {
+					return 0, WrapError(err, I18n.Sprintf("Save Stream file to cache failed: %v", err))
 				}
+			} else {
+				blob.Close()
+				t.ctx.Debug(I18n.Sprintf("Reuse cache: %s", filename))
+				netBytes = 0
+			}
+			r, err = t.ctx.Cache.Reuse(blobName)
+			if err != nil {
+				return 0, WrapError(err, I18n.Sprintf("Read file from cache failed: %v", err))
+			}
+		} else {
+			filename, err := t.ctx.Temp.SaveFile(blobName, blob, size)
+			if err != nil {
+				return 0, WrapError(err, I18n.Sprintf("Save Stream file to temp failed: %v", err))
+			}
+			defer t.ctx.Temp.Remove(filename)
+			r, err = os.Open(filename)
+			if err != nil {
+				return 0, err
 			}
 		}
-		if netBytes > 0 {
-			t.ctx.StatDown(netBytes, time.Since(begin))
+		// the tar can not be rewound, so no retry after it is written
+		if err = tar.AppendFileStream(blobName, size, r); err != nil {
+			return 0, &noRetryError{err}
 		}
-		t.ctx.CompMeta.BlobDone(b.Digest.Hex(), t.url)
 	}
-	return nil
+	return netBytes, nil
 }
 
 type OfflineUploadTask struct {
@@ -184,6 +219,9 @@ type OfflineUploadTask struct {
 }
 
 func NewOfflineUploadTask(ctx *TaskContext, ids *ImageDestination, url string, path string) Task {
+	if ids != nil {
+		ids.SetBlobCache(ctx.BlobCache)
+	}
 	return &OfflineUploadTask{
 		ctx:       ctx,
 		ids:       ids,
@@ -211,32 +249,136 @@ func (t *OfflineUploadTask) Status() string {
 }
 
 func (t *OfflineUploadTask) Run(tid int) error {
-	manifestJson := t.ctx.CompMeta.Manifests[t.url]
+	manifestByte := []byte(t.ctx.CompMeta.Manifests[t.url])
+	manifestType := manifest.GuessMIMEType(manifestByte)
+
+	var dockerSaver *DockerSaver
+	if t.ctx.DockerTarget != "" {
+		dockerSaver = NewDockerSaver(t.ctx, t.ctx.DockerTarget)
+		platformManifest, err := t.ctx.CompMeta.PlatformManifest(string(manifestByte))
+		if err != nil {
+			return fmt.Errorf(I18n.Sprintf("Manifest format error: %v, manifest: %s", err, string(manifestByte)))
+		}
+		_, err = t.uploadImage([]byte(platformManifest), dockerSaver, false)
+		return err
+	}
+
+	// check the overwrite policy before uploading any blob, the recompressed image is checked by its new manifest
+	recompress := NewRecompressor(t.ctx, t.ids) != nil
+	if !recompress {
+		if err := t.ids.CheckOverwrite(manifestByte); err != nil {
+			return ReportOverwrite(t.ctx, err)
+		}
+	}
+
+	if !manifest.MIMETypeIsMultiImage(manifestType) {
+		_, err := t.uploadImage(manifestByte, nil, false)
+		return err
+	}
+
+	list, err := manifest.ListFromBlob(manifestByte, manifestType)
+	if err != nil {
+		return fmt.Errorf(I18n.Sprintf("Manifest format error: %v, manifest: %s", err, string(manifestByte)))
+	}
+	descriptors, err := ManifestListDescriptors(manifestByte, manifestType)
+	if err != nil {
+		return fmt.Errorf(I18n.Sprintf("Manifest format error: %v, manifest: %s", err, string(manifestByte)))
+	}
+
+	var updates []manifest.ListUpdate
+	var changed bool
+	for _, d := range descriptors {
+		subManifestJson, ok := t.ctx.CompMeta.SubManifests[d.Digest.String()]
+		if !ok {
+			return fmt.Errorf(I18n.Sprintf("Manifest %v of OS:%s Architecture:%s not found in meta file, please download %s again", d.Digest, d.OS, d.Architecture, t.url))
+		}
+		subManifestByte, err := t.uploadImage([]byte(subManifestJson), nil, true)
+		if err != nil {
+			return err
+		}
+		// the blob digests may be updated in squashfs mode or by the recompression, so do the manifest list
+		subDigest, err := manifest.Digest(subManifestByte)
+		if err != nil {
+			return err
+		}
+		mediaType := d.MediaType
+		if subDigest != d.Digest {
+			changed = true
+			mediaType = manifest.GuessMIMEType(subManifestByte)
+		}
+		updates = append(updates, manifest.ListUpdate{
+			Digest:    subDigest,
+			Size:      int64(len(subManifestByte)),
+			MediaType: mediaType,
+		})
+	}
+
+	if changed {
+		if err := list.UpdateInstances(updates); err != nil {
+			return err
+		}
+		manifestByte, err = list.Serialize()
+		if err != nil {
+			return err
+		}
+	}
+
+	if recompress {
+		if err := t.ids.CheckOverwrite(manifestByte); err != nil {
+			return ReportOverwrite(t.ctx, err)
+		}
+	}
+
+	dstUrl := fmt.Sprintf("%s/%s:%s", t.ids.GetRegistry(), t.ids.GetRepository(), t.ids.GetTag())
+	if err := t.ids.PushManifest(manifestByte); err != nil {
+		return WrapError(err, I18n.Sprintf("Put manifestList to %s error: %v", dstUrl, err))
+	}
+	t.ctx.Info(I18n.Sprintf("Put manifestList to %s", dstUrl))
+	return nil
+}
+
+// uploadImage pushes the blobs and the manifest of a single platform image, the platform specified
+// manifest of a manifest list is pushed by digest, the manifest may be updated and returned
+func (t *OfflineUploadTask) uploadImage(manifestByte []byte, dockerSaver *DockerSaver, subManifest bool) ([]byte, error) {
 	m := Manifest{}
-	manifestByte := []byte(manifestJson)
 	err := json.Unmarshal(manifestByte, &m)
 	if err != nil {
-		return fmt.Errorf(I18n.Sprintf("Manifest format error: %v, manifest: %s", err, manifestJson))
+		return nil, fmt.Errorf(I18n.Sprintf("Manifest format error: %v, manifest: %s", err, string(manifestByte)))
 	}
 
 	var blobs []types.BlobInfo
 	blobs = append(blobs, m.Config)
 	blobs = append(blobs, m.Layers...)
 
-	var dockerSaver *DockerSaver
-	if t.ctx.DockerTarget != "" {
-		dockerSaver = NewDockerSaver(t.ctx, t.ctx.DockerTarget)
+	// the layers in another compression are converted to the one of the target
+	var rc *Recompressor
+	if dockerSaver == nil {
+		rc = NewRecompressor(t.ctx, t.ids)
 	}
+	converted := make(map[digest.Digest]types.BlobInfo)
+	var diffIDs []digest.Digest
 
 	var dstUrl string
 	for i, b := range blobs {
 		blobExist := false
+		convert := rc != nil && i > 0 && rc.NeedConvert(b)
 		var err error
 		if t.ids != nil {
 			dstUrl = fmt.Sprintf("%s/%s:%s", t.ids.GetRegistry(), t.ids.GetRepository(), t.ids.GetTag())
-			blobExist, err = t.ids.CheckBlobExist(b)
+			if convert {
+				var c types.BlobInfo
+				c, blobExist, err = rc.Converted(b)
+				if blobExist {
+					converted[b.Digest] = c
+				}
+			} else {
+				blobExist, err = t.ids.CheckBlobExist(b)
+			}
 			if err != nil {
-				return fmt.Errorf(I18n.Sprintf("Check blob %s(%v) to %s exist error: %v", b.Digest.String(), FormatByteSize(b.Size), dstUrl, err))
+				return nil, WrapError(err, I18n.Sprintf("Check blob %s(%v) to %s exist error: %v", b.Digest.String(), FormatByteSize(b.Size), dstUrl, err))
+			}
+			if !blobExist && !convert && MountBlob(t.ctx, t.ids, b, dstUrl) {
+				continue
 			}
 		}
 		if blobExist {
@@ -249,7 +391,7 @@ func (t *OfflineUploadTask) Run(tid int) error {
 				if t.ctx.SquashfsTar != nil {
 					rawRdr, err := t.ctx.SquashfsTar.GetFileStream(b.Digest.Hex())
 					if err != nil {
-						return err
+						return nil, err
 					}
 					layerHash := sha256.New()
 					rsw := NewReaderSumWrapper(rawRdr)
@@ -257,7 +399,7 @@ func (t *OfflineUploadTask) Run(tid int) error {
 
 					reader, err = t.ctx.SquashfsTar.GetFileStream(b.Digest.Hex())
 					if err != nil {
-						return err
+						return nil, err
 					}
 
 					d, _ := digest.Parse("sha256:" + hex.EncodeToString(layerHash.Sum(nil)))
@@ -281,7 +423,7 @@ func (t *OfflineUploadTask) Run(tid int) error {
 				} else {
 					r, err := NewImageCompressedTarReader(filepath.Join(t.path, k), t.ctx.CompMeta.Compressor)
 					if err != nil {
-						return err
+						return nil, err
 					}
 					defer r.Close()
 					rdr, name, size, eof, err := r.ReadFileStreamByName(b.Digest.Hex())
@@ -289,10 +431,10 @@ func (t *OfflineUploadTask) Run(tid int) error {
 						continue
 					}
 					if err != nil {
-						return err
+						return nil, err
 					}
 					if size != b.Size {
-						return fmt.Errorf(I18n.Sprintf("Blob %s size mismatch, size in meta: %v, size in tar: %v", name, b.Size, size))
+						return nil, fmt.Errorf(I18n.Sprintf("Blob %s size mismatch, size in meta: %v, size in tar: %v", name, b.Size, size))
 					}
 					reader = rdr
 					netBytes = size
@@ -310,11 +452,35 @@ func (t *OfflineUploadTask) Run(tid int) error {
 					}
 					found = true
 					break
+				} else if convert {
+					var diffID digest.Digest
+					if len(diffIDs) == len(m.Layers) {
+						diffID = diffIDs[i-1]
+					}
+					begin := time.Now()
+					c, upBytes, err := rc.Convert(reader, b, diffID)
+					if err != nil {
+						return nil, WrapError(err, I18n.Sprintf("Recompress blob %s(%v) to %s failed: %v", b.Digest.String(), FormatByteSize(b.Size), dstUrl, err))
+					}
+					t.ctx.Debug(I18n.Sprintf("Put blob %s(%v) to %s success", ShortenString(c.Digest.String(), 19), FormatByteSize(c.Size), dstUrl))
+					t.ctx.StatUp(upBytes, time.Since(begin))
+					converted[b.Digest] = c
+					found = true
+					break
 				} else {
+					// the diff ids of the config verify the converted layers
+					if rc != nil && i == 0 {
+						configByte, err := ioutil.ReadAll(reader)
+						if err != nil {
+							return nil, err
+						}
+						diffIDs = DiffIDs(configByte)
+						reader = bytes.NewReader(configByte)
+					}
 					begin := time.Now()
-					err = t.ids.PutABlob(ioutil.NopCloser(reader), b)
+					err = t.ids.PutABlob(NewRateLimitReader(t.ctx.Context, ioutil.NopCloser(reader), t.ids.GetRateLimiter()), b)
 					if err != nil {
-						return fmt.Errorf(I18n.Sprintf("Put blob %s(%v) to %s failed: %v", b.Digest, b.Size, t.ids.GetRegistry(), t.ids.GetRepository(), t.ids.GetTag(), err))
+						return nil, WrapError(err, I18n.Sprintf("Put blob %s(%v) to %s failed: %v", ShortenString(b.Digest.String(), 19), FormatByteSize(b.Size), dstUrl, err))
 					} else {
 						t.ctx.Debug(I18n.Sprintf("Put blob %s(%v) to %s success", ShortenString(b.Digest.String(), 19), FormatByteSize(b.Size), dstUrl))
 						t.ctx.StatUp(netBytes, time.Since(begin))
@@ -324,25 +490,48 @@ func (t *OfflineUploadTask) Run(tid int) error {
 				}
 			}
 			if dockerSaver == nil && !found {
-				return fmt.Errorf(I18n.Sprintf("Blob not found in datafiles: %s", b.Digest.Hex()))
+				return nil, fmt.Errorf(I18n.Sprintf("Blob not found in datafiles: %s", b.Digest.Hex()))
 			}
 			if t.ctx.Cancel() {
-				return fmt.Errorf(I18n.Sprintf("User cancelled..."))
+				return nil, fmt.Errorf(I18n.Sprintf("User cancelled..."))
 			}
 		}
 	}
 
+	if rc != nil {
+		manifestByte, _, err = rc.UpdateManifest(manifestByte, manifest.GuessMIMEType(manifestByte), converted)
+		if err != nil {
+			return nil, err
+		}
+	}
+
 	if dockerSaver == nil {
-		if err := t.ids.PushManifest(manifestByte); err != nil {
-			return fmt.Errorf(I18n.Sprintf("Put manifest to %s error: %v", dstUrl, err))
+		if subManifest {
+			subDigest, err := manifest.Digest(manifestByte)
+			if err != nil {
+				return nil, err
+			}
+			if err := t.ids.PushSubManifest(manifestByte, subDigest); err != nil {
+				return nil, WrapError(err, I18n.Sprintf("Put manifest to %s error: %v", dstUrl, err))
+			}
+			t.ctx.Debug(I18n.Sprintf("Put manifest %s to %s", ShortenString(subDigest.String(), 19), dstUrl))
+		} else {
+			if rc != nil {
+				if err := t.ids.CheckOverwrite(manifestByte); err != nil {
+					return nil, ReportOverwrite(t.ctx, err)
+				}
+			}
+			if err := t.ids.PushManifest(manifestByte); err != nil {
+				return nil, WrapError(err, I18n.Sprintf("Put manifest to %s error: %v", dstUrl, err))
+			}
+			t.ctx.Info(I18n.Sprintf("Put manifest to %s", dstUrl))
 		}
-		t.ctx.Info(I18n.Sprintf("Put manifest to %s", dstUrl))
 	} else {
 		dockerSaver.AppendMeta(&m, t.url)
 		dockerSaver.Close()
 	}
 
-	return nil
+	return manifestByte, nil
 }
 
 type Manifest struct {
@@ -3,11 +3,15 @@ package core
 import (
 	"fmt"
 	"io"
+	"io/ioutil"
 	"strings"
+	"sync"
 	"time"
 
 	"github.com/containers/image/v5/manifest"
 	"github.com/containers/image/v5/pkg/blobinfocache/none"
+	"github.com/containers/image/v5/types"
+	"github.com/opencontainers/go-digest"
 	"github.com/pkg/errors"
 )
 
@@ -28,6 +32,8 @@ type OnlineTask struct {
 	byteUp       int64
 	timeDown     time.Duration
 	timeUp       time.Duration
+	// the layers are transferred in parallel
+	statLock sync.Mutex
 }
 
 // NewTask creates a task
@@ -38,6 +44,8 @@ func NewOnlineTask(source *ImageSource, destination *ImageDestination, ctx *Task
 func NewOnlineTaskCallback(source *ImageSource, destination *ImageDestination, ctx *TaskContext, callback func(bool, string)) Task {
 	srcUrl := fmt.Sprintf("%s/%s:%s", source.GetRegistry(), source.GetRepository(), source.GetTag())
 	dstUrl := fmt.Sprintf("%s/%s:%s", destination.GetRegistry(), destination.GetRepository(), destination.GetTag())
+	source.SetBlobCache(ctx.BlobCache)
+	destination.SetBlobCache(ctx.BlobCache)
 	return &OnlineTask{
 		source:       source,
 		destination:  destination,
@@ -63,10 +71,14 @@ func (t *OnlineTask) Callback(success bool, content string) {
 }
 
 func (t *OnlineTask) StatDown(size int64, duration time.Duration) {
+	t.statLock.Lock()
+	defer t.statLock.Unlock()
 	t.byteDown = t.byteDown + size
 	t.timeDown = t.timeDown + duration
 }
 func (t *OnlineTask) StatUp(size int64, duration time.Duration) {
+	t.statLock.Lock()
+	defer t.statLock.Unlock()
 	t.byteUp = t.byteUp + size
 	t.timeUp = t.timeUp + duration
 }
@@ -74,105 +86,202 @@ func (t *OnlineTask) Status() string {
 	return I18n.Sprintf("Speed:^%s/s v%s/s Total:^%s v%s", FormatByteSize(int64(float64(t.byteDown)/(float64(t.timeDown)/float64(time.Second)))), FormatByteSize(int64(float64(t.byteUp)/(float64(t.timeUp)/float64(time.Second)))), FormatByteSize(t.byteDown), FormatByteSize(t.byteUp))
 }
 
-// Run ids the main function of a task
-func (t *OnlineTask) Run(idx int) error {
-	// get manifest from source
-	manifestByte, manifestType, err := t.source.GetManifest()
+// upToDate checks if the destination tag has the same manifest as the source, the blobs need not be checked then
+func (t *OnlineTask) upToDate(manifestByte []byte) bool {
+	srcDigest, err := manifest.Digest(manifestByte)
 	if err != nil {
-		return errors.New(I18n.Sprintf("Failed to get manifest from %s error: %v", t.srcUrl, err))
+		return false
 	}
-	t.ctx.Info(I18n.Sprintf("Get manifest from %s", t.srcUrl))
-
-	blobInfos, err := t.source.GetBlobInfos(manifestByte, manifestType)
+	dstDigest, err := t.destination.GetManifestDigest()
 	if err != nil {
-		return errors.New(I18n.Sprintf("Get blob info from %s error: %v", t.srcUrl, err))
+		t.ctx.Debug(I18n.Sprintf("Get manifest digest of %s failed: %v", t.dstUrl, err))
+		return false
 	}
+	return dstDigest == srcDigest
+}
 
-	// blob transformation
-	for _, b := range blobInfos {
+// syncBlob makes the blob exist in the destination, if another task is transferring the same blob to the registry,
+// it waits and checks again, then the blob is found or mounted from the repository of the other task
+func (t *OnlineTask) syncBlob(b types.BlobInfo) error {
+	key := t.destination.GetRegistry() + "@" + b.Digest.String()
+	for {
 		blobExist, err := t.destination.CheckBlobExist(b)
 		if err != nil {
-			return errors.New(I18n.Sprintf("Check blob %s(%v) to %s exist error: %v", b.Digest.String(), FormatByteSize(b.Size), t.srcUrl, err))
+			return WrapError(err, I18n.Sprintf("Check blob %s(%v) to %s exist error: %v", b.Digest.String(), FormatByteSize(b.Size), t.srcUrl, err))
+		}
+		if blobExist {
+			// print the log of ignored blob
+			t.ctx.Info(I18n.Sprintf("Blob %s(%v) has been pushed to %s, will not be pulled", ShortenString(b.Digest.String(), 19), FormatByteSize(b.Size), t.dstUrl))
+			return nil
+		}
+		if MountBlob(t.ctx, t.destination, b, t.dstUrl) {
+			return nil
 		}
 
-		if !blobExist {
-			// pull a blob from source
-			begin := time.Now()
-			blob, size, err := t.source.GetABlob(b)
-			if err != nil {
-				return errors.New(I18n.Sprintf("Get blob %s(%v) from %s failed: %v", b.Digest.String(), FormatByteSize(b.Size), t.srcUrl, err))
-			}
-			t.ctx.Debug(I18n.Sprintf("Get a blob %s(%v) from %s success", ShortenString(b.Digest.String(), 19), FormatByteSize(b.Size), t.srcUrl))
-
-			if t.ctx.Cancel() {
+		done := t.ctx.Inflight.BlobStart(key)
+		if done == nil {
+			defer t.ctx.Inflight.BlobDone(key)
+			if !t.ctx.AcquireStream() {
 				return errors.New(I18n.Sprintf("User cancelled..."))
 			}
+			defer t.ctx.ReleaseStream()
+			return RetryBlob(t.ctx, t.srcUrl, b, func() error { return t.transferBlob(b) })
+		}
+		t.ctx.Debug(I18n.Sprintf("Blob %s(%v) is being transferred by another task, wait for it", ShortenString(b.Digest.String(), 19), FormatByteSize(b.Size)))
+		select {
+		case <-done:
+		case <-t.ctx.Context.Done():
+			return errors.New(I18n.Sprintf("User cancelled..."))
+		}
+	}
+}
 
-			b.Size = size
-			var upReader io.ReadCloser
-			var downSize int64
-			var blobName string
-			var wCloser io.WriteCloser
-			var rCloser io.ReadCloser
-			// skip the empty gzip layer or tar-split will failed, and many empty HEXs here, using size more safe
-			if strings.HasSuffix(b.MediaType, "tar.gzip") && b.Size > 64*1024 {
-				blobName = b.Digest.Hex() + ".tar.gz"
-			} else {
-				blobName = b.Digest.Hex() + ".raw"
+// transferBlob pulls a blob from the source and pushes it to the destination, the unit of the blob level retry
+func (t *OnlineTask) transferBlob(b types.BlobInfo) error {
+	// pull a blob from source
+	begin := time.Now()
+	blob, size, err := t.source.GetABlob(b)
+	if err != nil {
+		return WrapError(err, I18n.Sprintf("Get blob %s(%v) from %s failed: %v", b.Digest.String(), FormatByteSize(b.Size), t.srcUrl, err))
+	}
+	t.ctx.Debug(I18n.Sprintf("Get a blob %s(%v) from %s success", ShortenString(b.Digest.String(), 19), FormatByteSize(b.Size), t.srcUrl))
+	// closed on failures too, a broken transfer must not hold the connection
+	defer blob.Close()
+
+	if t.ctx.Cancel() {
+		return errors.New(I18n.Sprintf("User cancelled..."))
+	}
+
+	b.Size = size
+	var upReader io.ReadCloser
+	var downSize int64
+	var blobName string
+	// skip the empty gzip layer or tar-split will failed, and many empty HEXs here, using size more safe
+	if strings.HasSuffix(b.MediaType, "tar.gzip") && b.Size > 64*1024 {
+		blobName = b.Digest.Hex() + ".tar.gz"
+	} else {
+		blobName = b.Digest.Hex() + ".raw"
+	}
+	if t.ctx.Cache != nil {
+		match, _ := t.ctx.Cache.Match(blobName, size)
+		if match {
+			upReader, err = t.ctx.Cache.Reuse(blobName)
+			t.ctx.Debug(I18n.Sprintf("Reuse cache: %s", blobName))
+			downSize = 0
+			if err != nil {
+				return WrapError(err, I18n.Sprintf("Read file from cache failed %s", err))
 			}
-			if t.ctx.Cache != nil {
-				match, _ := t.ctx.Cache.Match(blobName, size)
-				if match {
-					upReader, err = t.ctx.Cache.Reuse(blobName)
-					t.ctx.Debug(I18n.Sprintf("Reuse cache: %s", blobName))
-					downSize = 0
-					if err != nil {
-						return errors.New(I18n.Sprintf("Read file from cache failed %s", err))
-					}
-				} else {
-					downSize = size
-					upReader, wCloser, _ = t.ctx.Cache.SaveStream(blobName, blob)
-				}
-				rCloser = blob
-			} else {
-				upReader = blob
-				downSize = size
+		} else {
+			var wCloser io.WriteCloser
+			downSize = size
+			upReader, wCloser, _ = t.ctx.Cache.SaveStream(blobName, blob)
+			if wCloser != nil {
+				defer wCloser.Close()
 			}
+		}
+	} else {
+		upReader = blob
+		downSize = size
+	}
 
-			// push a blob to destination
-			if err := t.destination.PutABlob(upReader, b); err != nil {
-				return errors.New(I18n.Sprintf("Put blob %s(%v) to %s failed: %v", b.Digest, b.Size, t.destination.GetRegistry(), t.destination.GetRepository(), t.destination.GetTag(), err))
-			}
-			t.ctx.Info(I18n.Sprintf("Put blob %s(%v) to %s success", ShortenString(b.Digest.String(), 19), FormatByteSize(b.Size), t.dstUrl))
+	// push a blob to destination
+	upReader = NewRateLimitReader(t.ctx.Context, upReader, t.source.GetRateLimiter(), t.destination.GetRateLimiter())
+	if err := t.destination.PutABlob(upReader, b); err != nil {
+		return WrapError(err, I18n.Sprintf("Put blob %s(%v) to %s failed: %v", ShortenString(b.Digest.String(), 19), FormatByteSize(b.Size), t.dstUrl, err))
+	}
+	t.ctx.Info(I18n.Sprintf("Put blob %s(%v) to %s success", ShortenString(b.Digest.String(), 19), FormatByteSize(b.Size), t.dstUrl))
 
-			duration := time.Since(begin)
+	duration := time.Since(begin)
 
-			if downSize > 0 {
-				t.ctx.StatDown(downSize, duration)
-				t.StatDown(downSize, duration)
+	if downSize > 0 {
+		t.ctx.StatDown(downSize, duration)
+		t.StatDown(downSize, duration)
+	}
+	t.ctx.StatUp(size, duration)
+	t.StatUp(size, duration)
+
+	if t.ctx.Cancel() {
+		return errors.New(I18n.Sprintf("User cancelled..."))
+	}
+	return nil
+}
+
+// Run ids the main function of a task
+func (t *OnlineTask) Run(idx int) error {
+	// get manifest from source
+	manifestByte, manifestType, err := t.source.GetManifest()
+	if err != nil {
+		return WrapError(err, I18n.Sprintf("Failed to get manifest from %s error: %v", t.srcUrl, err))
+	}
+	t.ctx.Info(I18n.Sprintf("Get manifest from %s", t.srcUrl))
+	ReportMirror(t.ctx, t.source, t.srcUrl)
+
+	if t.upToDate(manifestByte) {
+		t.ctx.Info(I18n.Sprintf("Image %s is up to date, skipped", t.dstUrl))
+		t.ctx.Report(I18n.Sprintf("Images up to date"), t.dstUrl)
+		return nil
+	}
+
+	// the layers are converted to the compression of the target, which produces a new manifest
+	if r := NewRecompressor(t.ctx, t.destination); r != nil {
+		if err := t.pushRecompressed(r, manifestByte, manifestType); err != nil {
+			if err = ReportOverwrite(t.ctx, err); err != nil {
+				return err
 			}
-			t.ctx.StatUp(size, duration)
-			t.StatUp(size, duration)
+		} else {
+			t.ctx.Info(I18n.Sprintf("Transmit successfully from %s to %s", t.srcUrl, t.dstUrl))
+		}
+		if t.ctx.History != nil {
+			t.ctx.History.Add(t.srcUrl)
+		}
+		return nil
+	}
 
-			if wCloser != nil {
-				wCloser.Close()
+	// check the overwrite policy before transferring any blob, the converted schema1 image is checked by its new manifest
+	schema1 := IsSchema1(manifestType) && t.destination.GetSchema1Policy() != SCHEMA1_KEEP
+	if !schema1 {
+		if err := t.destination.CheckOverwrite(manifestByte); err != nil {
+			if err = ReportOverwrite(t.ctx, err); err != nil {
+				return err
 			}
-			if rCloser != nil {
-				rCloser.Close()
+			if t.ctx.History != nil {
+				t.ctx.History.Add(t.srcUrl)
 			}
+			return nil
+		}
+	}
 
-			if t.ctx.Cancel() {
-				return errors.New(I18n.Sprintf("User cancelled..."))
-			}
-		} else {
-			// print the log of ignored blob
-			t.ctx.Info(I18n.Sprintf("Blob %s(%v) has been pushed to %s, will not be pulled", ShortenString(b.Digest.String(), 19), FormatByteSize(b.Size), t.dstUrl))
+	blobInfos, err := t.source.GetBlobInfos(manifestByte, manifestType)
+	if err != nil {
+		return WrapError(err, I18n.Sprintf("Get blob info from %s error: %v", t.srcUrl, err))
+	}
+
+	// blob transformation, the layers are transferred in parallel within the stream budget of the run
+	var wg sync.WaitGroup
+	errs := make(chan error, len(blobInfos))
+	parallel := make(chan int, t.ctx.MaxStreams())
+	for _, b := range blobInfos {
+		parallel <- 1
+		wg.Add(1)
+		go func(b types.BlobInfo) {
+			defer func() {
+				<-parallel
+				wg.Done()
+			}()
+			errs <- t.syncBlob(b)
+		}(b)
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		if err != nil {
+			return err
 		}
 	}
 
 	//Push manifest list
-	if manifestType == manifest.DockerV2ListMediaType {
-		manifestSchemaListInfo, err := manifest.Schema2ListFromManifest(manifestByte)
+	if manifest.MIMETypeIsMultiImage(manifestType) {
+		descriptors, err := ManifestListDescriptors(manifestByte, manifestType)
 		if err != nil {
 			return err
 		}
@@ -180,28 +289,38 @@ func (t *OnlineTask) Run(idx int) error {
 		var subManifestByte []byte
 
 		// push manifest to destination
-		for _, manifestDescriptorElem := range manifestSchemaListInfo.Manifests {
-			subManifestByte, _, err = t.source.source.GetManifest(t.source.ctx, &manifestDescriptorElem.Digest)
+		for _, manifestDescriptorElem := range descriptors {
+			subManifestByte, _, err = t.source.GetSubManifest(manifestDescriptorElem.Digest)
 			if err != nil {
-				return errors.New(I18n.Sprintf("Get manifest %v of OS:%s Architecture:%s for manifest list error: %v", manifestDescriptorElem.Digest, manifestDescriptorElem.Platform.OS, manifestDescriptorElem.Platform.Architecture, err))
+				return WrapError(err, I18n.Sprintf("Get manifest %v of OS:%s Architecture:%s for manifest list error: %v", manifestDescriptorElem.Digest, manifestDescriptorElem.OS, manifestDescriptorElem.Architecture, err))
 			}
 
-			if err := t.destination.PushManifest(subManifestByte); err != nil {
-				return errors.New(I18n.Sprintf("Put manifest to %s error: %v", t.dstUrl, err))
+			if err := t.destination.PushSubManifest(subManifestByte, manifestDescriptorElem.Digest); err != nil {
+				return WrapError(err, I18n.Sprintf("Put manifest to %s error: %v", t.dstUrl, err))
 			}
 		}
 
 		// push manifest list to destination
 		if err := t.destination.PushManifest(manifestByte); err != nil {
-			return errors.New(I18n.Sprintf("Put manifestList to %s error: %v", t.dstUrl, err))
+			return WrapError(err, I18n.Sprintf("Put manifestList to %s error: %v", t.dstUrl, err))
 		}
 
 		t.ctx.Info(I18n.Sprintf("Put manifestList to %s", t.dstUrl))
 
+	} else if schema1 {
+		if err := t.pushSchema1(manifestByte); err != nil {
+			if err = ReportOverwrite(t.ctx, err); err != nil {
+				return err
+			}
+			if t.ctx.History != nil {
+				t.ctx.History.Add(t.srcUrl)
+			}
+			return nil
+		}
 	} else {
 		// push manifest to destination
 		if err := t.destination.PushManifest(manifestByte); err != nil {
-			return errors.New(I18n.Sprintf("Put manifest to %s error: %v", t.dstUrl, err))
+			return WrapError(err, I18n.Sprintf("Put manifest to %s error: %v", t.dstUrl, err))
 		}
 		t.ctx.Info(I18n.Sprintf("Put manifest to %s", t.dstUrl))
 	}
@@ -213,6 +332,284 @@ func (t *OnlineTask) Run(idx int) error {
 	return nil
 }
 
+// pushRecompressed converts the layers of the image, or of each image of the manifest list, then pushes the new
+// manifests, the overwrite policy is checked against the new manifest as the source one is never pushed
+func (t *OnlineTask) pushRecompressed(r *Recompressor, manifestByte []byte, manifestType string) error {
+	if !manifest.MIMETypeIsMultiImage(manifestType) {
+		newManifestByte, _, err := t.recompressImage(r, manifestByte, manifestType)
+		if err != nil {
+			return err
+		}
+		if err := t.destination.CheckOverwrite(newManifestByte); err != nil {
+			return err
+		}
+		if err := t.destination.PushManifest(newManifestByte); err != nil {
+			return WrapError(err, I18n.Sprintf("Put manifest to %s error: %v", t.dstUrl, err))
+		}
+		t.ctx.Info(I18n.Sprintf("Put manifest to %s", t.dstUrl))
+		return nil
+	}
+
+	list, err := manifest.ListFromBlob(manifestByte, manifestType)
+	if err != nil {
+		return err
+	}
+	descriptors, err := ManifestListDescriptors(manifestByte, manifestType)
+	if err != nil {
+		return err
+	}
+	var updates []manifest.ListUpdate
+	for _, d := range descriptors {
+		subManifestByte, subManifestType, err := t.source.GetSubManifest(d.Digest)
+		if err != nil {
+			return WrapError(err, I18n.Sprintf("Get manifest %v of OS:%s Architecture:%s for manifest list error: %v", d.Digest, d.OS, d.Architecture, err))
+		}
+		newManifestByte, newManifestType, err := t.recompressImage(r, subManifestByte, subManifestType)
+		if err != nil {
+			return err
+		}
+		newDigest, err := manifest.Digest(newManifestByte)
+		if err != nil {
+			return err
+		}
+		if err := t.destination.PushSubManifest(newManifestByte, newDigest); err != nil {
+			return WrapError(err, I18n.Sprintf("Put manifest to %s error: %v", t.dstUrl, err))
+		}
+		updates = append(updates, manifest.ListUpdate{
+			Digest:    newDigest,
+			Size:      int64(len(newManifestByte)),
+			MediaType: newManifestType,
+		})
+	}
+	if err := list.UpdateInstances(updates); err != nil {
+		return err
+	}
+	newManifestByte, err := list.Serialize()
+	if err != nil {
+		return err
+	}
+	if err := t.destination.CheckOverwrite(newManifestByte); err != nil {
+		return err
+	}
+	if err := t.destination.PushManifest(newManifestByte); err != nil {
+		return WrapError(err, I18n.Sprintf("Put manifestList to %s error: %v", t.dstUrl, err))
+	}
+	t.ctx.Info(I18n.Sprintf("Put manifestList to %s", t.dstUrl))
+	return nil
+}
+
+// recompressImage makes the config and the layers of an image exist in the destination, the layers in another
+// compression are converted, the new manifest and its type are returned
+func (t *OnlineTask) recompressImage(r *Recompressor, manifestByte []byte, manifestType string) ([]byte, string, error) {
+	// the schema1 image has no config, it is converted to schema2 first
+	var configByte []byte
+	if IsSchema1(manifestType) {
+		var err error
+		manifestByte, configByte, err = t.convertSchema1(manifestByte)
+		if err != nil {
+			return nil, "", err
+		}
+		manifestType = manifest.DockerV2Schema2MediaType
+	}
+	m, err := manifest.FromBlob(manifestByte, manifestType)
+	if err != nil {
+		return nil, "", err
+	}
+
+	// the diff ids of the config verify the converted layers
+	if configByte == nil {
+		config := m.ConfigInfo()
+		if err := t.syncBlob(config); err != nil {
+			return nil, "", err
+		}
+		blob, _, err := t.source.GetABlob(config)
+		if err != nil {
+			return nil, "", WrapError(err, I18n.Sprintf("Get blob %s(%v) from %s failed: %v", config.Digest.String(), FormatByteSize(config.Size), t.srcUrl, err))
+		}
+		configByte, err = ioutil.ReadAll(blob)
+		blob.Close()
+		if err != nil {
+			return nil, "", WrapError(err, I18n.Sprintf("Get blob %s(%v) from %s failed: %v", config.Digest.String(), FormatByteSize(config.Size), t.srcUrl, err))
+		}
+	}
+	layers := m.LayerInfos()
+	diffIDs := DiffIDs(configByte)
+	if len(diffIDs) != len(layers) {
+		diffIDs = nil
+	}
+
+	var wg sync.WaitGroup
+	errs := make(chan error, len(layers))
+	parallel := make(chan int, t.ctx.MaxStreams())
+	converted := make(map[digest.Digest]types.BlobInfo)
+	var convertedLock sync.Mutex
+	for idx, l := range layers {
+		var diffID digest.Digest
+		if diffIDs != nil {
+			diffID = diffIDs[idx]
+		}
+		parallel <- 1
+		wg.Add(1)
+		go func(b types.BlobInfo, diffID digest.Digest) {
+			defer func() {
+				<-parallel
+				wg.Done()
+			}()
+			if !r.NeedConvert(b) {
+				errs <- t.syncBlob(b)
+				return
+			}
+			c, err := t.recompressBlob(r, b, diffID)
+			if err == nil {
+				convertedLock.Lock()
+				converted[b.Digest] = c
+				convertedLock.Unlock()
+			}
+			errs <- err
+		}(l.BlobInfo, diffID)
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		if err != nil {
+			return nil, "", err
+		}
+	}
+	return r.UpdateManifest(manifestByte, manifestType, converted)
+}
+
+// recompressBlob makes the converted layer exist in the destination like syncBlob, the layer converted by
+// another task is reused
+func (t *OnlineTask) recompressBlob(r *Recompressor, b types.BlobInfo, diffID digest.Digest) (types.BlobInfo, error) {
+	key := t.destination.GetRegistry() + "@" + r.Name() + "@" + b.Digest.String()
+	for {
+		c, blobExist, err := r.Converted(b)
+		if err != nil {
+			return c, WrapError(err, I18n.Sprintf("Check blob %s(%v) to %s exist error: %v", c.Digest.String(), FormatByteSize(c.Size), t.srcUrl, err))
+		}
+		if blobExist {
+			t.ctx.Info(I18n.Sprintf("Blob %s(%v) has been pushed to %s, will not be pulled", ShortenString(c.Digest.String(), 19), FormatByteSize(c.Size), t.dstUrl))
+			return c, nil
+		}
+
+		done := t.ctx.Inflight.BlobStart(key)
+		if done == nil {
+			defer t.ctx.Inflight.BlobDone(key)
+			if !t.ctx.AcquireStream() {
+				return c, errors.New(I18n.Sprintf("User cancelled..."))
+			}
+			defer t.ctx.ReleaseStream()
+			err = RetryBlob(t.ctx, t.srcUrl, b, func() error {
+				c, err = t.convertBlob(r, b, diffID)
+				return err
+			})
+			return c, err
+		}
+		t.ctx.Debug(I18n.Sprintf("Blob %s(%v) is being transferred by another task, wait for it", ShortenString(b.Digest.String(), 19), FormatByteSize(b.Size)))
+		select {
+		case <-done:
+		case <-t.ctx.Context.Done():
+			return c, errors.New(I18n.Sprintf("User cancelled..."))
+		}
+	}
+}
+
+// convertBlob pulls a layer from the source, converts and pushes it to the destination
+func (t *OnlineTask) convertBlob(r *Recompressor, b types.BlobInfo, diffID digest.Digest) (types.BlobInfo, error) {
+	begin := time.Now()
+	blob, size, err := t.source.GetABlob(b)
+	if err != nil {
+		return types.BlobInfo{}, WrapError(err, I18n.Sprintf("Get blob %s(%v) from %s failed: %v", b.Digest.String(), FormatByteSize(b.Size), t.srcUrl, err))
+	}
+	defer blob.Close()
+
+	c, upSize, err := r.Convert(blob, b, diffID, t.source.GetRateLimiter())
+	if err != nil {
+		return c, WrapError(err, I18n.Sprintf("Recompress blob %s(%v) to %s failed: %v", b.Digest.String(), FormatByteSize(b.Size), t.dstUrl, err))
+	}
+	t.ctx.Info(I18n.Sprintf("Put blob %s(%v) to %s success", ShortenString(c.Digest.String(), 19), FormatByteSize(c.Size), t.dstUrl))
+
+	duration := time.Since(begin)
+	t.ctx.StatDown(size, duration)
+	t.StatDown(size, duration)
+	if upSize > 0 {
+		t.ctx.StatUp(upSize, duration)
+		t.StatUp(upSize, duration)
+	}
+
+	if t.ctx.Cancel() {
+		return c, errors.New(I18n.Sprintf("User cancelled..."))
+	}
+	return c, nil
+}
+
+// pushSchema1 pushes a schema1 manifest by the schema1 policy of the destination, it is converted to schema2
+// by the "convert" policy, or by the "auto" policy if the destination refuses it
+func (t *OnlineTask) pushSchema1(manifestByte []byte) error {
+	if t.destination.GetSchema1Policy() == SCHEMA1_AUTO {
+		if err := t.destination.CheckOverwrite(manifestByte); err != nil {
+			return err
+		}
+		err := t.destination.PushManifest(manifestByte)
+		if err == nil {
+			t.ctx.Info(I18n.Sprintf("Put manifest to %s", t.dstUrl))
+			return nil
+		}
+		if !IsManifestRejected(err) {
+			return WrapError(err, I18n.Sprintf("Put manifest to %s error: %v", t.dstUrl, err))
+		}
+		t.ctx.Info(I18n.Sprintf("The schema1 manifest is refused by %s: %v", t.dstUrl, err))
+	}
+
+	newManifestByte, _, err := t.convertSchema1(manifestByte)
+	if err != nil {
+		return err
+	}
+	if err := t.destination.CheckOverwrite(newManifestByte); err != nil {
+		return err
+	}
+	if err := t.destination.PushManifest(newManifestByte); err != nil {
+		return WrapError(err, I18n.Sprintf("Put manifest to %s error: %v", t.dstUrl, err))
+	}
+	t.ctx.Info(I18n.Sprintf("Put manifest to %s", t.dstUrl))
+	return nil
+}
+
+// convertSchema1 converts a schema1 manifest to schema2 and pushes the new config, the layers are kept
+func (t *OnlineTask) convertSchema1(manifestByte []byte) ([]byte, []byte, error) {
+	newManifestByte, configByte, err := NewSchema1Converter(t.ctx, t.source, t.srcUrl).Convert(manifestByte)
+	if err != nil {
+		return nil, nil, WrapError(err, I18n.Sprintf("Convert the schema1 manifest of %s failed: %v", t.srcUrl, err))
+	}
+	if err := pushConfig(t.destination, configByte); err != nil {
+		return nil, nil, WrapError(err, I18n.Sprintf("Put blob %s(%v) to %s failed: %v", ShortenString(digest.FromBytes(configByte).String(), 19), FormatByteSize(int64(len(configByte))), t.dstUrl, err))
+	}
+	return newManifestByte, configByte, nil
+}
+
+// MountBlob mounts a blob from the other repositories of the destination registry if possible,
+// a failed mount is not an error as the blob will be uploaded then
+func MountBlob(ctx *TaskContext, ids *ImageDestination, b types.BlobInfo, dstUrl string) bool {
+	repos, mounted, err := ids.MountBlob(b)
+	if err != nil {
+		ctx.Debug(I18n.Sprintf("Mount blob %s(%v) to %s from %s failed: %v", ShortenString(b.Digest.String(), 19), FormatByteSize(b.Size), dstUrl, strings.Join(repos, ","), err))
+		return false
+	}
+	if mounted {
+		ctx.Info(I18n.Sprintf("Mount blob %s(%v) to %s from %s", ShortenString(b.Digest.String(), 19), FormatByteSize(b.Size), dstUrl, strings.Join(repos, ",")))
+	}
+	return mounted
+}
+
+// ReportMirror logs and reports the mirror if the image is not served by the registry
+func ReportMirror(ctx *TaskContext, is *ImageSource, srcUrl string) {
+	if is.GetEndpoint() == is.GetRegistry() {
+		return
+	}
+	ctx.Info(I18n.Sprintf("Image %s is served by mirror %s", srcUrl, is.GetEndpoint()))
+	ctx.Report(I18n.Sprintf("Images served by mirrors"), fmt.Sprintf("%s <- %s", srcUrl, is.GetEndpoint()))
+}
+
 func ShortenString(str string, n int) string {
 	if len(str) <= n {
 		return str
@@ -0,0 +1,79 @@
+package core
+
+import (
+	"fmt"
+
+	"github.com/containers/image/v5/manifest"
+	"github.com/opencontainers/go-digest"
+	"github.com/pkg/errors"
+)
+
+// the overwrite policies of a target, when the tag exists and points to another manifest
+const (
+	// replace the tag, the default
+	OVERWRITE_ALWAYS = "always"
+	// keep the tag and skip the image
+	OVERWRITE_NEVER = "never"
+	// keep the tag and fail the image
+	OVERWRITE_FAIL_IF_DIFFERENT = "fail-if-different"
+)
+
+// OverwriteError is returned when the overwrite policy refuses to replace a tag pointing to another manifest
+type OverwriteError struct {
+	Url      string
+	Policy   string
+	Existing digest.Digest
+	Pushing  digest.Digest
+}
+
+func (e *OverwriteError) Error() string {
+	return I18n.Sprintf("Tag %s points to %s, refused to overwrite with %s by the policy %s", e.Url, e.Existing, e.Pushing, e.Policy)
+}
+
+// checkOverwritePolicy validates the overwrite policy of a repo
+func checkOverwritePolicy(policy string) error {
+	switch policy {
+	case "", OVERWRITE_ALWAYS, OVERWRITE_NEVER, OVERWRITE_FAIL_IF_DIFFERENT:
+		return nil
+	}
+	return fmt.Errorf("invalid overwrite policy %s, should be one of %s, %s, %s", policy, OVERWRITE_ALWAYS, OVERWRITE_NEVER, OVERWRITE_FAIL_IF_DIFFERENT)
+}
+
+// CheckOverwrite returns an OverwriteError if the policy refuses to replace the tag by the manifest
+func (i *ImageDestination) CheckOverwrite(manifestByte []byte) error {
+	if i.overwrite == "" || i.overwrite == OVERWRITE_ALWAYS {
+		return nil
+	}
+	pushing, err := manifest.Digest(manifestByte)
+	if err != nil {
+		return err
+	}
+	existing, err := i.GetManifestDigest()
+	if err != nil {
+		return WrapError(err, I18n.Sprintf("Get manifest digest of %s failed: %v", i.GetRegistry()+"/"+i.GetRepository()+":"+i.GetTag(), err))
+	}
+	if existing == "" || existing == pushing {
+		return nil
+	}
+	return &OverwriteError{
+		Url:      i.GetRegistry() + "/" + i.GetRepository() + ":" + i.GetTag(),
+		Policy:   i.overwrite,
+		Existing: existing,
+		Pushing:  pushing,
+	}
+}
+
+// ReportOverwrite records a refused overwrite in the summary, nil is returned if the image should be skipped
+// quietly by the "never" policy, otherwise the error is returned
+func ReportOverwrite(ctx *TaskContext, err error) error {
+	var oe *OverwriteError
+	if !errors.As(err, &oe) {
+		return err
+	}
+	ctx.Report(I18n.Sprintf("Refused overwrites"), I18n.Sprintf("%s existing: %s, new: %s", oe.Url, oe.Existing, oe.Pushing))
+	if oe.Policy == OVERWRITE_NEVER {
+		ctx.Info(I18n.Sprintf("Image %s exists with another manifest, skipped by the overwrite policy", oe.Url))
+		return nil
+	}
+	return err
+}
@@ -0,0 +1,398 @@
+package core
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"strings"
+	"sync"
+	"text/tabwriter"
+
+	"github.com/containers/image/v5/manifest"
+	"github.com/containers/image/v5/types"
+	"github.com/pkg/errors"
+)
+
+const (
+	PLAN_NEW        = "new"
+	PLAN_CHANGED    = "changed"
+	PLAN_UP_TO_DATE = "up-to-date"
+	PLAN_FAILED     = "failed"
+)
+
+// PlanImage is the estimate of an image in the plan mode
+type PlanImage struct {
+	Source        string `json:"source"`
+	Destination   string `json:"destination,omitempty"`
+	Status        string `json:"status"`
+	Digest        string `json:"digest,omitempty"`
+	Blobs         int    `json:"blobs"`
+	NewBlobs      int    `json:"newBlobs"`
+	TotalBytes    int64  `json:"totalBytes"`
+	TransferBytes int64  `json:"transferBytes"`
+	// the sizes of the blobs are not in the schema1 manifest, the bytes are not counted
+	UnknownSize bool   `json:"unknownSize,omitempty"`
+	Error       string `json:"error,omitempty"`
+}
+
+// Plan is the result of the plan mode, the blobs shared by the images are counted once
+type Plan struct {
+	Mode          string       `json:"mode"`
+	Images        []*PlanImage `json:"images"`
+	TotalBytes    int64        `json:"totalBytes"`
+	TransferBytes int64        `json:"transferBytes"`
+	Failed        int          `json:"failed"`
+	// the images of unknown size, not counted in the bytes
+	UnknownSize int `json:"unknownSize,omitempty"`
+}
+
+// Planner resolves the images like a real run and estimates the data to transfer, nothing is written
+type Planner struct {
+	ctx  *TaskContext
+	plan *Plan
+	// the blobs counted by the former images, keyed by registry@digest
+	seen     map[string]bool
+	seenChan chan int
+}
+
+// NewPlanner creates a Planner of the mode: transmit, download or upload
+func NewPlanner(ctx *TaskContext, mode string) *Planner {
+	return &Planner{
+		ctx:      ctx,
+		plan:     &Plan{Mode: mode},
+		seen:     make(map[string]bool),
+		seenChan: make(chan int, 1),
+	}
+}
+
+// Run plans the images of the list by the parallel goroutines, the results keep the order of the list
+func (p *Planner) Run(list []string, parallel int, plan func(rawURL string) *PlanImage) *Plan {
+	if parallel < 1 {
+		parallel = 1
+	}
+	images := make([]*PlanImage, len(list))
+	var wg sync.WaitGroup
+	routines := make(chan int, parallel)
+	for idx, rawURL := range list {
+		if p.ctx.Cancel() {
+			break
+		}
+		routines <- 1
+		wg.Add(1)
+		go func(idx int, rawURL string) {
+			defer func() {
+				<-routines
+				wg.Done()
+			}()
+			images[idx] = plan(rawURL)
+		}(idx, rawURL)
+	}
+	wg.Wait()
+
+	for _, img := range images {
+		if img == nil {
+			continue
+		}
+		p.plan.Images = append(p.plan.Images, img)
+		p.plan.TotalBytes = p.plan.TotalBytes + img.TotalBytes
+		p.plan.TransferBytes = p.plan.TransferBytes + img.TransferBytes
+		if img.Status == PLAN_FAILED {
+			p.plan.Failed++
+		}
+		if img.UnknownSize {
+			p.plan.UnknownSize++
+		}
+	}
+	return p.plan
+}
+
+// PlanOnline estimates an image of the transmit mode, the blobs are checked in the destination
+func (p *Planner) PlanOnline(imgSrc string, srcRepo *Repo, imgDst string, dstRepo *Repo) *PlanImage {
+	img := &PlanImage{Source: imgSrc, Destination: imgDst}
+	srcURL, err := NewRepoURL(strings.TrimPrefix(strings.TrimPrefix(imgSrc, "https://"), "http://"))
+	if err != nil {
+		return p.fail(img, I18n.Sprintf("Url %s format error: %v, skipped", imgSrc, err))
+	}
+	is, err := NewImageSource(p.ctx.Context, srcURL.GetRegistry(), srcURL.GetRepoWithNamespace(), srcURL.GetTag(), srcRepo, InsecureTarget(imgSrc))
+	if err != nil {
+		return p.fail(img, I18n.Sprintf("Url %s format error: %v, skipped", imgSrc, err))
+	}
+	defer is.Close()
+
+	dstURL, err := NewRepoURL(strings.TrimPrefix(strings.TrimPrefix(imgDst, "https://"), "http://"))
+	if err != nil {
+		return p.fail(img, I18n.Sprintf("Url %s format error: %v, skipped", imgDst, err))
+	}
+	id, err := NewImageDestination(p.ctx.Context, dstURL.GetRegistry(), dstURL.GetRepoWithNamespace(), dstURL.GetTag(), dstRepo, InsecureTarget(imgDst))
+	if err != nil {
+		return p.fail(img, I18n.Sprintf("Url %s format error: %v, skipped", imgDst, err))
+	}
+	defer id.Close()
+
+	blobInfos, ok := p.sourceBlobs(img, is)
+	if !ok {
+		return img
+	}
+
+	dstDigest, err := id.GetManifestDigest()
+	if err != nil {
+		return p.fail(img, I18n.Sprintf("Get manifest digest of %s failed: %v", imgDst, err))
+	}
+	switch string(dstDigest) {
+	case img.Digest:
+		img.Status = PLAN_UP_TO_DATE
+		return img
+	case "":
+		img.Status = PLAN_NEW
+	default:
+		img.Status = PLAN_CHANGED
+	}
+	return p.checkDestination(img, id, blobInfos)
+}
+
+// PlanDownload estimates an image of the download mode, the blobs in the CompMeta(ex: loaded from the "-inc" meta) are skipped
+func (p *Planner) PlanDownload(url string, repo *Repo) *PlanImage {
+	img := &PlanImage{Source: url, Status: PLAN_NEW}
+	srcURL, err := NewRepoURL(strings.TrimPrefix(strings.TrimPrefix(url, "https://"), "http://"))
+	if err != nil {
+		return p.fail(img, I18n.Sprintf("Url %s format error: %v, skipped", url, err))
+	}
+	is, err := NewImageSource(p.ctx.Context, srcURL.GetRegistry(), srcURL.GetRepoWithNamespace(), srcURL.GetTag(), repo, InsecureTarget(url))
+	if err != nil {
+		return p.fail(img, I18n.Sprintf("Url %s format error: %v, skipped", url, err))
+	}
+	defer is.Close()
+
+	blobInfos, ok := p.sourceBlobs(img, is)
+	if !ok {
+		return img
+	}
+	for _, b := range blobInfos {
+		if p.ctx.CompMeta != nil && p.ctx.CompMeta.BlobExists(b.Digest.Hex()) {
+			continue
+		}
+		if p.claim(b.Digest.String()) {
+			p.transfer(img, b)
+		}
+	}
+	return img
+}
+
+// PlanUpload estimates an image of the upload mode by the manifests in the CompMeta, all the blobs are counted
+// if the url is empty(the docker or ctr target)
+func (p *Planner) PlanUpload(srcUrl string, url string, repo *Repo) *PlanImage {
+	img := &PlanImage{Source: srcUrl, Destination: url, Status: PLAN_NEW}
+	manifestJson, ok := p.ctx.CompMeta.Manifests[srcUrl]
+	if !ok {
+		return p.fail(img, I18n.Sprintf("Image %s not found in meta file", srcUrl))
+	}
+	manifestByte := []byte(manifestJson)
+	if url == "" {
+		platformManifest, err := p.ctx.CompMeta.PlatformManifest(manifestJson)
+		if err != nil {
+			return p.fail(img, I18n.Sprintf("Manifest format error: %v, manifest: %s", err, manifestJson))
+		}
+		manifestByte = []byte(platformManifest)
+	}
+	d, err := manifest.Digest(manifestByte)
+	if err != nil {
+		return p.fail(img, I18n.Sprintf("Manifest format error: %v, manifest: %s", err, string(manifestByte)))
+	}
+	img.Digest = d.String()
+
+	blobInfos, err := p.metaBlobs(manifestByte)
+	if err != nil {
+		return p.fail(img, err.Error())
+	}
+	p.count(img, blobInfos)
+
+	if url == "" {
+		for _, b := range blobInfos {
+			p.transfer(img, b)
+		}
+		return img
+	}
+
+	dstURL, err := NewRepoURL(strings.TrimPrefix(strings.TrimPrefix(url, "https://"), "http://"))
+	if err != nil {
+		return p.fail(img, I18n.Sprintf("Url %s format error: %v, skipped", url, err))
+	}
+	id, err := NewImageDestination(p.ctx.Context, dstURL.GetRegistry(), dstURL.GetRepoWithNamespace(), dstURL.GetTag(), repo, InsecureTarget(url))
+	if err != nil {
+		return p.fail(img, I18n.Sprintf("Url %s format error: %v, skipped", url, err))
+	}
+	defer id.Close()
+
+	dstDigest, err := id.GetManifestDigest()
+	if err != nil {
+		return p.fail(img, I18n.Sprintf("Get manifest digest of %s failed: %v", url, err))
+	}
+	switch dstDigest {
+	case d:
+		img.Status = PLAN_UP_TO_DATE
+		return img
+	case "":
+		img.Status = PLAN_NEW
+	default:
+		img.Status = PLAN_CHANGED
+	}
+	return p.checkDestination(img, id, blobInfos)
+}
+
+// sourceBlobs gets the manifest and the blobs of the source image
+func (p *Planner) sourceBlobs(img *PlanImage, is *ImageSource) ([]types.BlobInfo, bool) {
+	manifestByte, manifestType, err := is.GetManifest()
+	if err != nil {
+		p.fail(img, I18n.Sprintf("Failed to get manifest from %s error: %v", img.Source, err))
+		return nil, false
+	}
+	d, err := manifest.Digest(manifestByte)
+	if err != nil {
+		p.fail(img, I18n.Sprintf("Manifest format error: %v, manifest: %s", err, string(manifestByte)))
+		return nil, false
+	}
+	img.Digest = d.String()
+
+	blobInfos, err := is.GetBlobInfos(manifestByte, manifestType)
+	if err != nil {
+		p.fail(img, I18n.Sprintf("Get blob info from %s error: %v", img.Source, err))
+		return nil, false
+	}
+	p.count(img, blobInfos)
+	return blobInfos, true
+}
+
+// metaBlobs returns the blobs of a manifest in the meta file, the platform specified manifests of a manifest list included
+func (p *Planner) metaBlobs(manifestByte []byte) ([]types.BlobInfo, error) {
+	manifestType := manifest.GuessMIMEType(manifestByte)
+	if IsSchema1(manifestType) {
+		// the sizes are unknown, counted by count()
+		m, err := manifest.Schema1FromManifest(manifestByte)
+		if err != nil {
+			return nil, errors.New(I18n.Sprintf("Manifest format error: %v, manifest: %s", err, string(manifestByte)))
+		}
+		var blobInfos []types.BlobInfo
+		for _, l := range m.LayerInfos() {
+			blobInfos = append(blobInfos, l.BlobInfo)
+		}
+		return blobInfos, nil
+	}
+	if !manifest.MIMETypeIsMultiImage(manifestType) {
+		m := Manifest{}
+		if err := json.Unmarshal(manifestByte, &m); err != nil {
+			return nil, errors.New(I18n.Sprintf("Manifest format error: %v, manifest: %s", err, string(manifestByte)))
+		}
+		return append([]types.BlobInfo{m.Config}, m.Layers...), nil
+	}
+
+	descriptors, err := ManifestListDescriptors(manifestByte, manifestType)
+	if err != nil {
+		return nil, errors.New(I18n.Sprintf("Manifest format error: %v, manifest: %s", err, string(manifestByte)))
+	}
+	var blobInfos []types.BlobInfo
+	for _, d := range descriptors {
+		subManifestJson, ok := p.ctx.CompMeta.SubManifests[d.Digest.String()]
+		if !ok {
+			return nil, errors.New(I18n.Sprintf("Manifest %v of OS:%s Architecture:%s not found in meta file", d.Digest, d.OS, d.Architecture))
+		}
+		b, err := p.metaBlobs([]byte(subManifestJson))
+		if err != nil {
+			return nil, err
+		}
+		blobInfos = append(blobInfos, b...)
+	}
+	return blobInfos, nil
+}
+
+// checkDestination counts the blobs not found in the destination
+func (p *Planner) checkDestination(img *PlanImage, id *ImageDestination, blobInfos []types.BlobInfo) *PlanImage {
+	for _, b := range blobInfos {
+		if p.ctx.Cancel() {
+			return p.fail(img, I18n.Sprintf("User cancelled..."))
+		}
+		// the blob counted by another image will be pushed or mounted once
+		if !p.claim(id.GetRegistry() + "@" + b.Digest.String()) {
+			continue
+		}
+		exist, err := id.CheckBlobExist(b)
+		if err != nil {
+			return p.fail(img, I18n.Sprintf("Check blob %s(%v) to %s exist error: %v", b.Digest.String(), FormatByteSize(b.Size), img.Destination, err))
+		}
+		if !exist {
+			p.transfer(img, b)
+		}
+	}
+	return img
+}
+
+// claim returns true if the blob is not counted yet
+func (p *Planner) claim(key string) bool {
+	p.seenChan <- 1
+	defer func() {
+		<-p.seenChan
+	}()
+	if p.seen[key] {
+		return false
+	}
+	p.seen[key] = true
+	return true
+}
+
+func (p *Planner) count(img *PlanImage, blobInfos []types.BlobInfo) {
+	img.Blobs = len(blobInfos)
+	for _, b := range blobInfos {
+		// the size is unknown in the schema1 manifest
+		if b.Size > 0 {
+			img.TotalBytes = img.TotalBytes + b.Size
+		} else if b.Size < 0 {
+			img.UnknownSize = true
+		}
+	}
+}
+
+func (p *Planner) transfer(img *PlanImage, b types.BlobInfo) {
+	img.NewBlobs++
+	if b.Size > 0 {
+		img.TransferBytes = img.TransferBytes + b.Size
+	}
+}
+
+func (p *Planner) fail(img *PlanImage, msg string) *PlanImage {
+	img.Status = PLAN_FAILED
+	img.Error = msg
+	p.ctx.Error(msg)
+	return img
+}
+
+// Print shows the plan as a table
+func (p *Planner) Print() {
+	var sb strings.Builder
+	w := tabwriter.NewWriter(&sb, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, I18n.Sprintf("STATUS\tBLOBS\tTRANSFER\tTOTAL\tIMAGE"))
+	for _, img := range p.plan.Images {
+		name := img.Source
+		if img.Destination != "" {
+			name = img.Source + " -> " + img.Destination
+		}
+		transfer, total := FormatByteSize(img.TransferBytes), FormatByteSize(img.TotalBytes)
+		if img.UnknownSize {
+			transfer, total = I18n.Sprintf("unknown"), I18n.Sprintf("unknown")
+		}
+		fmt.Fprintf(w, "%s\t%v/%v\t%s\t%s\t%s\n", img.Status, img.NewBlobs, img.Blobs, transfer, total, name)
+	}
+	w.Flush()
+	p.ctx.Info(I18n.Sprintf("Plan of %s mode:\n%s", p.plan.Mode, strings.TrimRight(sb.String(), "\n")))
+	p.ctx.Info(I18n.Sprintf("Total %v images, %v failed, %s to transfer of %s", len(p.plan.Images), p.plan.Failed, FormatByteSize(p.plan.TransferBytes), FormatByteSize(p.plan.TotalBytes)))
+	if p.plan.UnknownSize > 0 {
+		p.ctx.Info(I18n.Sprintf("The sizes of %v images in schema1 are unknown and not counted", p.plan.UnknownSize))
+	}
+}
+
+// Save writes the plan to the file in json
+func (p *Planner) Save(filename string) error {
+	b, err := json.MarshalIndent(p.plan, "", "  ")
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(filename, b, 0644)
+}
@@ -0,0 +1,178 @@
+package core
+
+import (
+	"fmt"
+	"regexp"
+	"sort"
+
+	"github.com/mcuadros/go-version"
+	"github.com/opencontainers/go-digest"
+	"github.com/pkg/errors"
+)
+
+var (
+	// the tags ordered by version in the keep mode, ex: 1.2.3, v2.0-rc1, 20210612, but not latest or a commit hash
+	versionTagPattern = regexp.MustCompile(`^[vV]?[0-9]+(\.[0-9]+)*([-+_.][0-9A-Za-z][0-9A-Za-z.+_-]*)?$`)
+)
+
+// PruneCfg configures the mirror mode which prunes the destination tags
+type PruneCfg struct {
+	// keep the newest N tags by version, 0 means deleting the tags missing from the source.
+	// Only the version tags are counted, the others(ex: latest) are kept
+	Keep int `yaml:"keep,omitempty"`
+	// the tags matching these regular expressions are never deleted
+	Protected []string `yaml:"protected,omitempty"`
+}
+
+// TagPruner deletes the destination tags no longer present in the source, or the ones older than the newest "keep"
+// tags, by the same version ordering as the watch mode. Nothing is deleted in the dry run.
+type TagPruner struct {
+	ctx       *TaskContext
+	keep      int
+	protected []*regexp.Regexp
+	dryRun    bool
+}
+
+// NewTagPruner creates a TagPruner
+func NewTagPruner(ctx *TaskContext, cfg PruneCfg, dryRun bool) (*TagPruner, error) {
+	p := &TagPruner{
+		ctx:    ctx,
+		keep:   cfg.Keep,
+		dryRun: dryRun,
+	}
+	for _, s := range cfg.Protected {
+		r, err := regexp.Compile("^(" + s + ")$")
+		if err != nil {
+			return nil, fmt.Errorf("invalid protected tag %s: %v", s, err)
+		}
+		p.protected = append(p.protected, r)
+	}
+	return p, nil
+}
+
+// Prune prunes the tags of the destination repository against the source repository
+func (p *TagPruner) Prune(is *ImageSource, id *ImageDestination) error {
+	dstRepoUrl := id.GetRegistry() + "/" + id.GetRepository()
+
+	dstTags, err := id.GetTags()
+	if err != nil {
+		return WrapError(err, I18n.Sprintf("Fetch tag list failed for %v with error: %v", dstRepoUrl, err))
+	}
+	var srcTags []string
+	if p.keep <= 0 {
+		srcTags, err = is.GetSourceRepoTags()
+		if err != nil {
+			return WrapError(err, I18n.Sprintf("Fetch tag list failed for %v with error: %v", is.GetRegistry()+"/"+is.GetRepository(), err))
+		}
+		// an empty list is more likely a wrong source than a request to delete everything
+		if len(srcTags) == 0 {
+			return errors.New(I18n.Sprintf("No tag found in %s, skip pruning %s", is.GetRegistry()+"/"+is.GetRepository(), dstRepoUrl))
+		}
+	}
+
+	prune := p.selectTags(srcTags, dstTags)
+	if len(prune) == 0 {
+		p.ctx.Info(I18n.Sprintf("No tag to prune in %s", dstRepoUrl))
+		return nil
+	}
+
+	// a manifest is deleted by digest, which deletes all of its tags, so the ones shared with a kept tag are skipped
+	pruneSet := make(map[string]bool)
+	for _, tag := range prune {
+		pruneSet[tag] = true
+	}
+	keptDigests := make(map[digest.Digest]string)
+	for _, tag := range dstTags {
+		if pruneSet[tag] {
+			continue
+		}
+		d, err := id.GetTagDigest(tag)
+		if err != nil {
+			return WrapError(err, I18n.Sprintf("Get manifest digest of %s failed: %v", dstRepoUrl+":"+tag, err))
+		}
+		keptDigests[d] = tag
+	}
+
+	deleted := make(map[digest.Digest]bool)
+	for _, tag := range prune {
+		if p.ctx.Cancel() {
+			return errors.New(I18n.Sprintf("User cancelled..."))
+		}
+		url := dstRepoUrl + ":" + tag
+		d, err := id.GetTagDigest(tag)
+		if err != nil {
+			p.ctx.Error(I18n.Sprintf("Get manifest digest of %s failed: %v", url, err))
+			p.ctx.Report(I18n.Sprintf("Prune failed"), url)
+			continue
+		}
+		if d == "" || deleted[d] {
+			continue
+		}
+		if kept, ok := keptDigests[d]; ok {
+			p.ctx.Info(I18n.Sprintf("Tag %s shares the manifest %s with the kept tag %s, skipped", url, ShortenString(d.String(), 19), kept))
+			p.ctx.Report(I18n.Sprintf("Prune skipped"), url)
+			continue
+		}
+		if p.dryRun {
+			p.ctx.Report(I18n.Sprintf("Tags to prune"), url+"@"+d.String())
+			continue
+		}
+		if err := id.DeleteManifest(d); err != nil {
+			p.ctx.Error(I18n.Sprintf("Delete %s failed: %v", url, err))
+			p.ctx.Report(I18n.Sprintf("Prune failed"), url)
+			continue
+		}
+		deleted[d] = true
+		p.ctx.Info(I18n.Sprintf("Deleted %s", url+"@"+d.String()))
+		p.ctx.Report(I18n.Sprintf("Pruned tags"), url+"@"+d.String())
+	}
+	return nil
+}
+
+// selectTags returns the destination tags to prune, the protected tags excluded. In the keep mode only the version
+// tags are candidates, as the version ordering of a tag like "latest" or a commit hash makes no sense
+func (p *TagPruner) selectTags(srcTags []string, dstTags []string) []string {
+	var candidates []string
+	for _, tag := range dstTags {
+		if p.isProtected(tag) || (p.keep > 0 && !IsVersionTag(tag)) {
+			continue
+		}
+		candidates = append(candidates, tag)
+	}
+
+	if p.keep > 0 {
+		if len(candidates) <= p.keep {
+			return nil
+		}
+		sort.SliceStable(candidates, func(i, j int) bool {
+			return version.Compare(candidates[i], candidates[j], "<")
+		})
+		return candidates[:len(candidates)-p.keep]
+	}
+
+	srcSet := make(map[string]bool)
+	for _, tag := range srcTags {
+		srcSet[tag] = true
+	}
+	var prune []string
+	for _, tag := range candidates {
+		if !srcSet[tag] {
+			prune = append(prune, tag)
+		}
+	}
+	return prune
+}
+
+// IsVersionTag checks if the tag looks like a version
+func IsVersionTag(tag string) bool {
+	return versionTagPattern.MatchString(tag)
+}
+
+func (p *TagPruner) isProtected(tag string) bool {
+	for _, r := range p.protected {
+		if r.MatchString(tag) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,217 @@
+package core
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/opencontainers/go-digest"
+)
+
+func TestIsVersionTag(t *testing.T) {
+	cases := []struct {
+		tag     string
+		version bool
+	}{
+		{tag: "1", version: true},
+		{tag: "1.2.3", version: true},
+		{tag: "v2.0", version: true},
+		{tag: "V2.0.1", version: true},
+		{tag: "1.0-rc1", version: true},
+		{tag: "1.0.0+build.5", version: true},
+		{tag: "20210612", version: true},
+		{tag: "latest", version: false},
+		{tag: "abc123f", version: false},
+		{tag: "dev-1.0", version: false},
+		{tag: "v", version: false},
+		{tag: "", version: false},
+	}
+	for _, c := range cases {
+		if got := IsVersionTag(c.tag); got != c.version {
+			t.Errorf("IsVersionTag(%q): expect %v, got %v", c.tag, c.version, got)
+		}
+	}
+}
+
+func TestSelectTags(t *testing.T) {
+	cases := []struct {
+		name      string
+		keep      int
+		protected []string
+		src       []string
+		dst       []string
+		prune     []string
+	}{
+		{
+			name:  "keep the newest by version, the others kept",
+			keep:  2,
+			dst:   []string{"latest", "1.10", "1.2", "abc123f", "1.0", "v2.0"},
+			prune: []string{"1.0", "1.2"},
+		},
+		{
+			name:  "release candidate before release",
+			keep:  1,
+			dst:   []string{"1.0", "1.0-rc1"},
+			prune: []string{"1.0-rc1"},
+		},
+		{
+			name: "keep more than the version tags",
+			keep: 5,
+			dst:  []string{"latest", "1.0", "1.1", "dev"},
+		},
+		{
+			name: "keep equals the version tags",
+			keep: 2,
+			dst:  []string{"1.0", "1.1"},
+		},
+		{
+			name:      "protected not counted",
+			keep:      1,
+			protected: []string{"1\\.0.*"},
+			dst:       []string{"1.0", "1.0.1", "1.1", "1.2"},
+			prune:     []string{"1.1"},
+		},
+		{
+			name:  "missing from the source",
+			src:   []string{"1.0", "latest"},
+			dst:   []string{"1.0", "1.1", "latest", "dev"},
+			prune: []string{"1.1", "dev"},
+		},
+		{
+			name:      "missing from the source but protected",
+			protected: []string{"dev|release-.*"},
+			src:       []string{"1.0"},
+			dst:       []string{"1.0", "dev", "release-1", "1.1"},
+			prune:     []string{"1.1"},
+		},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			p, err := NewTagPruner(nil, PruneCfg{Keep: c.keep, Protected: c.protected}, true)
+			if err != nil {
+				t.Fatal(err)
+			}
+			got := p.selectTags(c.src, c.dst)
+			if len(got) != 0 || len(c.prune) != 0 {
+				if !reflect.DeepEqual(got, c.prune) {
+					t.Errorf("expect %v, got %v", c.prune, got)
+				}
+			}
+		})
+	}
+}
+
+// a registry serving the tags and the manifest digests of a repository, the deleted digests are recorded
+type pruneRegistry struct {
+	tags    []string
+	digests map[string]digest.Digest
+	m       sync.Mutex
+	deleted []digest.Digest
+}
+
+func (r *pruneRegistry) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	switch {
+	case req.URL.Path == "/v2/":
+		w.WriteHeader(http.StatusOK)
+	case strings.HasSuffix(req.URL.Path, "/tags/list"):
+		json.NewEncoder(w).Encode(map[string]interface{}{"name": "a/b", "tags": r.tags})
+	case strings.Contains(req.URL.Path, "/manifests/") && req.Method == http.MethodHead:
+		d, ok := r.digests[req.URL.Path[strings.LastIndex(req.URL.Path, "/")+1:]]
+		if !ok {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		w.Header().Set("Docker-Content-Digest", d.String())
+		w.WriteHeader(http.StatusOK)
+	case strings.Contains(req.URL.Path, "/manifests/") && req.Method == http.MethodDelete:
+		r.m.Lock()
+		r.deleted = append(r.deleted, digest.Digest(req.URL.Path[strings.LastIndex(req.URL.Path, "/")+1:]))
+		r.m.Unlock()
+		w.WriteHeader(http.StatusAccepted)
+	default:
+		w.WriteHeader(http.StatusNotFound)
+	}
+}
+
+func TestPruneSharedDigest(t *testing.T) {
+	InitI18nPrinter("")
+	a, b, c := digest.FromString("a"), digest.FromString("b"), digest.FromString("c")
+	cases := []struct {
+		name    string
+		keep    int
+		tags    []string
+		digests map[string]digest.Digest
+		deleted []digest.Digest
+		skipped []string
+	}{
+		{
+			name:    "shared with a kept non version tag",
+			keep:    1,
+			tags:    []string{"1.0", "1.1", "1.2", "latest"},
+			digests: map[string]digest.Digest{"1.0": a, "1.1": b, "1.2": c, "latest": b},
+			deleted: []digest.Digest{a},
+			skipped: []string{"1.1"},
+		},
+		{
+			name:    "shared with a kept version tag",
+			keep:    1,
+			tags:    []string{"1.0", "1.1"},
+			digests: map[string]digest.Digest{"1.0": a, "1.1": a},
+			skipped: []string{"1.0"},
+		},
+		{
+			name:    "shared by two pruned tags deleted once",
+			keep:    1,
+			tags:    []string{"1.0", "1.0.0", "1.1"},
+			digests: map[string]digest.Digest{"1.0": a, "1.0.0": a, "1.1": b},
+			deleted: []digest.Digest{a},
+		},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			registry := &pruneRegistry{tags: tc.tags, digests: tc.digests}
+			srv := httptest.NewServer(registry)
+			defer srv.Close()
+
+			ctx := NewTaskContext(&CmdLogger{}, nil, nil)
+			ctx.Reset()
+			id, err := NewImageDestination(context.Background(), strings.TrimPrefix(srv.URL, "http://"), "a/b", "", nil, true)
+			if err != nil {
+				t.Fatal(err)
+			}
+			p, err := NewTagPruner(ctx, PruneCfg{Keep: tc.keep}, false)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if err := p.Prune(nil, id); err != nil {
+				t.Fatal(err)
+			}
+
+			if len(registry.deleted) != 0 || len(tc.deleted) != 0 {
+				if !reflect.DeepEqual(registry.deleted, tc.deleted) {
+					t.Errorf("expect deleted %v, got %v", tc.deleted, registry.deleted)
+				}
+			}
+			var skipped []string
+			for _, r := range ctx.TakeReports() {
+				if r.Title == I18n.Sprintf("Prune skipped") {
+					for _, l := range r.Lines {
+						skipped = append(skipped, l[strings.LastIndex(l, ":")+1:])
+					}
+				}
+			}
+			if len(skipped) != 0 || len(tc.skipped) != 0 {
+				if !reflect.DeepEqual(skipped, tc.skipped) {
+					t.Errorf("expect skipped %v, got %v", tc.skipped, skipped)
+				}
+			}
+		})
+	}
+}
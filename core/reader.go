@@ -0,0 +1,118 @@
+package core
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"time"
+
+	log "github.com/cihub/seelog"
+	"github.com/opencontainers/go-digest"
+)
+
+var (
+	// BLOB_RESUME is the max times to reconnect a broken blob stream
+	BLOB_RESUME = 5
+)
+
+// ResumableReader reads a blob and reconnects from the broken offset after a read error,
+// the digest is verified when the stream ends
+type ResumableReader struct {
+	ctx      context.Context
+	reader   io.ReadCloser
+	open     func(offset int64) (io.ReadCloser, int64, error)
+	digest   digest.Digest
+	verifier digest.Verifier
+	size     int64
+	offset   int64
+	// offset of the last break, the count of resuming is reset if the stream moves on
+	broken  int64
+	resumed int
+}
+
+// NewResumableReader wraps the first stream of a blob, open is used to get the rest stream from the offset
+func NewResumableReader(ctx context.Context, reader io.ReadCloser, size int64, d digest.Digest, open func(offset int64) (io.ReadCloser, int64, error)) *ResumableReader {
+	r := &ResumableReader{
+		ctx:    ctx,
+		reader: reader,
+		open:   open,
+		digest: d,
+		size:   size,
+	}
+	if d.Validate() == nil {
+		r.verifier = d.Verifier()
+	}
+	return r
+}
+
+func (r *ResumableReader) Read(p []byte) (int, error) {
+	for {
+		if r.reader == nil {
+			if err := r.reconnect(); err != nil {
+				return 0, err
+			}
+		}
+
+		n, err := r.reader.Read(p)
+		if n > 0 {
+			r.offset = r.offset + int64(n)
+			if r.verifier != nil {
+				r.verifier.Write(p[:n])
+			}
+		}
+
+		if err == io.EOF && (r.size < 0 || r.offset >= r.size) {
+			if r.verifier != nil && !r.verifier.Verified() {
+				return n, fmt.Errorf("digest of blob %s mismatch, %v bytes read", r.digest, r.offset)
+			}
+			return n, io.EOF
+		}
+		if err == nil {
+			return n, nil
+		}
+
+		// the stream breaks, reconnect in the next read
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		r.reader.Close()
+		r.reader = nil
+		if r.offset > r.broken {
+			r.broken = r.offset
+			r.resumed = 0
+		}
+		if r.open == nil || r.resumed >= BLOB_RESUME || r.ctx.Err() != nil {
+			return n, err
+		}
+		r.resumed++
+		log.Warnf("Read blob %s broken at %v/%v: %v, resume %v/%v", r.digest, r.offset, r.size, err, r.resumed, BLOB_RESUME)
+		if n > 0 {
+			return n, nil
+		}
+	}
+}
+
+func (r *ResumableReader) reconnect() error {
+	var err error
+	for {
+		time.Sleep(time.Duration(r.resumed) * time.Second)
+		var reader io.ReadCloser
+		reader, _, err = r.open(r.offset)
+		if err == nil {
+			r.reader = reader
+			return nil
+		}
+		if r.resumed >= BLOB_RESUME || r.ctx.Err() != nil {
+			return err
+		}
+		r.resumed++
+		log.Warnf("Reconnect blob %s from %v failed: %v, resume %v/%v", r.digest, r.offset, err, r.resumed, BLOB_RESUME)
+	}
+}
+
+func (r *ResumableReader) Close() error {
+	if r.reader != nil {
+		return r.reader.Close()
+	}
+	return nil
+}
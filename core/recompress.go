@@ -0,0 +1,268 @@
+package core
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/containers/image/v5/manifest"
+	"github.com/containers/image/v5/pkg/compression"
+	"github.com/containers/image/v5/types"
+	"github.com/opencontainers/go-digest"
+	imgspecv1 "github.com/opencontainers/image-spec/specs-go/v1"
+)
+
+// ConvertedBlobs records the layers converted by the tasks of a run, keyed by the registry, the compression and
+// the source digest, so a layer shared by the images is converted once
+type ConvertedBlobs struct {
+	m     sync.Mutex
+	blobs map[string]types.BlobInfo
+}
+
+func NewConvertedBlobs() *ConvertedBlobs {
+	return &ConvertedBlobs{
+		blobs: make(map[string]types.BlobInfo),
+	}
+}
+
+// Get returns the converted layer of the key
+func (c *ConvertedBlobs) Get(key string) (types.BlobInfo, bool) {
+	c.m.Lock()
+	defer c.m.Unlock()
+	b, ok := c.blobs[key]
+	return b, ok
+}
+
+// Put records the converted layer of the key
+func (c *ConvertedBlobs) Put(key string, b types.BlobInfo) {
+	c.m.Lock()
+	defer c.m.Unlock()
+	c.blobs[key] = b
+}
+
+// Recompressor converts the layers pushed to a target to the compression of the target(the "recompress" of the repo),
+// ex: the registry only accepts gzip layers. The diff ids are not changed by the compression, so the config is kept
+// and the converted layers are verified against it, only the layer descriptors of the manifest are rewritten.
+type Recompressor struct {
+	ctx       *TaskContext
+	id        *ImageDestination
+	algorithm compression.Algorithm
+}
+
+// checkRecompress validates the "recompress" of a repo
+func checkRecompress(name string) error {
+	switch name {
+	case "", compression.Gzip.Name(), compression.Zstd.Name():
+		return nil
+	}
+	return fmt.Errorf("invalid recompress %s, should be %s or %s", name, compression.Gzip.Name(), compression.Zstd.Name())
+}
+
+// NewRecompressor creates a Recompressor for the destination, nil if the destination keeps the original compression
+func NewRecompressor(ctx *TaskContext, id *ImageDestination) *Recompressor {
+	if id == nil || id.recompress == "" {
+		return nil
+	}
+	algorithm, err := compression.AlgorithmByName(id.recompress)
+	if err != nil {
+		return nil
+	}
+	return &Recompressor{
+		ctx:       ctx,
+		id:        id,
+		algorithm: algorithm,
+	}
+}
+
+// Name returns the name of the target compression
+func (r *Recompressor) Name() string {
+	return r.algorithm.Name()
+}
+
+// NeedConvert checks if the blob is a layer in another compression, the config and the foreign layers are never converted
+func (r *Recompressor) NeedConvert(b types.BlobInfo) bool {
+	switch b.MediaType {
+	case manifest.DockerV2Schema2LayerMediaType, manifest.DockerV2SchemaLayerMediaTypeUncompressed,
+		imgspecv1.MediaTypeImageLayer, imgspecv1.MediaTypeImageLayerGzip, imgspecv1.MediaTypeImageLayerZstd:
+	default:
+		return false
+	}
+	var current string
+	switch {
+	case strings.HasSuffix(b.MediaType, "gzip"):
+		current = compression.Gzip.Name()
+	case strings.HasSuffix(b.MediaType, "zstd"):
+		current = compression.Zstd.Name()
+	}
+	return current != r.algorithm.Name()
+}
+
+// Converted returns the layer converted during the run, and if it exists in the destination
+func (r *Recompressor) Converted(b types.BlobInfo) (types.BlobInfo, bool, error) {
+	c, ok := r.ctx.Converted.Get(r.key(b.Digest))
+	if !ok {
+		return c, false, nil
+	}
+	exist, err := r.id.CheckBlobExist(c)
+	return c, exist, err
+}
+
+// Convert recompresses the layer from the reader to a temp file, verifies its diff id if given, then pushes it
+// if the destination does not have it. The converted blob and the bytes pushed are returned.
+func (r *Recompressor) Convert(reader io.Reader, b types.BlobInfo, diffID digest.Digest, limiters ...*RateLimiter) (types.BlobInfo, int64, error) {
+	_, decompressor, reader, err := compression.DetectCompressionFormat(reader)
+	if err != nil {
+		return types.BlobInfo{}, 0, err
+	}
+	uncompressed := ioutil.NopCloser(reader)
+	if decompressor != nil {
+		uncompressed, err = decompressor(reader)
+		if err != nil {
+			return types.BlobInfo{}, 0, err
+		}
+	}
+	defer uncompressed.Close()
+
+	file, filename, err := r.ctx.Temp.CreateFile(b.Digest.Hex() + "-" + strconv.FormatInt(time.Now().UnixNano(), 36) + "." + r.algorithm.Name())
+	if err != nil {
+		return types.BlobInfo{}, 0, err
+	}
+	defer r.ctx.Temp.Remove(filename)
+
+	diffIDDigester := digest.Canonical.Digester()
+	blobDigester := digest.Canonical.Digester()
+	writer, err := compression.CompressStream(io.MultiWriter(file, blobDigester.Hash()), r.algorithm, nil)
+	if err != nil {
+		file.Close()
+		return types.BlobInfo{}, 0, err
+	}
+	_, err = io.Copy(writer, io.TeeReader(uncompressed, diffIDDigester.Hash()))
+	if err == nil {
+		err = writer.Close()
+	}
+	if err == nil {
+		// read to the end, so that the source verifies the digest of the blob
+		_, err = io.Copy(ioutil.Discard, reader)
+	}
+	file.Close()
+	if err != nil {
+		return types.BlobInfo{}, 0, err
+	}
+	if diffID != "" && diffIDDigester.Digest() != diffID {
+		return types.BlobInfo{}, 0, &noRetryError{fmt.Errorf(I18n.Sprintf("Diff id of blob %s mismatch, %s in config, %s uncompressed", b.Digest, diffID, diffIDDigester.Digest()))}
+	}
+
+	info, err := os.Stat(filename)
+	if err != nil {
+		return types.BlobInfo{}, 0, err
+	}
+	algorithm := r.algorithm
+	converted := types.BlobInfo{
+		Digest:               blobDigester.Digest(),
+		Size:                 info.Size(),
+		CompressionOperation: types.Compress,
+		CompressionAlgorithm: &algorithm,
+	}
+	r.ctx.Debug(I18n.Sprintf("Recompress blob %s(%v) to %s %s(%v)", ShortenString(b.Digest.String(), 19), FormatByteSize(b.Size), r.algorithm.Name(), ShortenString(converted.Digest.String(), 19), FormatByteSize(converted.Size)))
+
+	var upBytes int64
+	exist, err := r.id.CheckBlobExist(converted)
+	if err != nil {
+		return types.BlobInfo{}, 0, err
+	}
+	if !exist {
+		f, err := os.Open(filename)
+		if err != nil {
+			return types.BlobInfo{}, 0, err
+		}
+		if err := r.id.PutABlob(NewRateLimitReader(r.ctx.Context, f, append(limiters, r.id.GetRateLimiter())...), converted); err != nil {
+			return types.BlobInfo{}, 0, err
+		}
+		upBytes = converted.Size
+	}
+
+	r.ctx.Converted.Put(r.key(b.Digest), converted)
+	return converted, upBytes, nil
+}
+
+// UpdateManifest rewrites the descriptors of the converted layers, the docker schema2 manifest is converted
+// to OCI for zstd which docker does not define. The new manifest and its type are returned.
+func (r *Recompressor) UpdateManifest(manifestByte []byte, manifestType string, converted map[digest.Digest]types.BlobInfo) ([]byte, string, error) {
+	m, err := manifest.FromBlob(manifestByte, manifestType)
+	if err != nil {
+		return nil, "", err
+	}
+	if s2, ok := m.(*manifest.Schema2); ok && r.algorithm.Name() == compression.Zstd.Name() && len(converted) > 0 {
+		m = schema2ToOCI(s2)
+		manifestType = imgspecv1.MediaTypeImageManifest
+	} else if len(converted) == 0 {
+		return manifestByte, manifestType, nil
+	}
+
+	var layers []types.BlobInfo
+	for _, l := range m.LayerInfos() {
+		if c, ok := converted[l.Digest]; ok {
+			c.Annotations = l.Annotations
+			layers = append(layers, c)
+		} else {
+			layers = append(layers, l.BlobInfo)
+		}
+	}
+	if err := m.UpdateLayerInfos(layers); err != nil {
+		return nil, "", err
+	}
+	manifestByte, err = m.Serialize()
+	return manifestByte, manifestType, err
+}
+
+func (r *Recompressor) key(d digest.Digest) string {
+	return r.id.GetRegistry() + "@" + r.algorithm.Name() + "@" + d.String()
+}
+
+// schema2ToOCI converts a docker schema2 manifest to OCI, the docker config is compatible with the OCI one
+func schema2ToOCI(m *manifest.Schema2) *manifest.OCI1 {
+	mediaTypes := map[string]string{
+		manifest.DockerV2Schema2LayerMediaType:            imgspecv1.MediaTypeImageLayerGzip,
+		manifest.DockerV2SchemaLayerMediaTypeUncompressed: imgspecv1.MediaTypeImageLayer,
+		manifest.DockerV2Schema2ForeignLayerMediaType:     imgspecv1.MediaTypeImageLayerNonDistributable,
+		manifest.DockerV2Schema2ForeignLayerMediaTypeGzip: imgspecv1.MediaTypeImageLayerNonDistributableGzip,
+	}
+	var layers []imgspecv1.Descriptor
+	for _, l := range m.LayersDescriptors {
+		mediaType, ok := mediaTypes[l.MediaType]
+		if !ok {
+			mediaType = l.MediaType
+		}
+		layers = append(layers, imgspecv1.Descriptor{
+			MediaType: mediaType,
+			Digest:    l.Digest,
+			Size:      l.Size,
+			URLs:      l.URLs,
+		})
+	}
+	config := imgspecv1.Descriptor{
+		MediaType: imgspecv1.MediaTypeImageConfig,
+		Digest:    m.ConfigDescriptor.Digest,
+		Size:      m.ConfigDescriptor.Size,
+	}
+	return manifest.OCI1FromComponents(config, layers)
+}
+
+// DiffIDs returns the diff ids of the layers in the image config, nil if the config has none
+func DiffIDs(configByte []byte) []digest.Digest {
+	var config struct {
+		RootFS struct {
+			DiffIDs []digest.Digest `json:"diff_ids"`
+		} `json:"rootfs"`
+	}
+	if err := json.Unmarshal(configByte, &config); err != nil {
+		return nil
+	}
+	return config.RootFS.DiffIDs
+}
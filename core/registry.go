@@ -0,0 +1,653 @@
+package core
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"mime"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	log "github.com/cihub/seelog"
+	"github.com/containers/image/v5/manifest"
+	"github.com/opencontainers/go-digest"
+)
+
+// RegistryClient talks to the registry v2 API directly, it supplies the abilities which the docker transport
+// of containers/image does not provide, like resuming a blob download with the "Range" header
+type RegistryClient struct {
+	registry string
+	username string
+	password string
+	insecure bool
+	scheme   string
+	client   *http.Client
+	// authorization header of each scope, the basic one is saved with the empty scope
+	auths    map[string]string
+	authChan chan int
+}
+
+// RegistryError is a unexpected http response of the registry
+type RegistryError struct {
+	StatusCode int
+	Status     string
+	Header     http.Header
+	Message    string
+	// the delay in the "Retry-After" header, parsed when the response is received as it may be a http date
+	Delay time.Duration
+}
+
+func (e *RegistryError) Error() string {
+	msg := e.Status
+	if e.Message != "" {
+		msg = fmt.Sprintf("%s: %s", e.Status, e.Message)
+	}
+	if e.Delay > 0 {
+		msg = fmt.Sprintf("%s (retry after %vs)", msg, int64(e.Delay.Seconds()))
+	}
+	return msg
+}
+
+// RetryAfter returns the delay in the "Retry-After" header
+func (e *RegistryError) RetryAfter() time.Duration {
+	return e.Delay
+}
+
+// NewRegistryClient creates a RegistryClient, an insecure registry may be served by http,
+// the tlsConfig(see NewTLSConfig) carries the CA, the client certificate and whether to verify the certificate,
+// the registry is connected by the proxy(see RepoProxy), or by the environment proxy if nil
+func NewRegistryClient(registry string, username string, password string, insecure bool, tlsConfig *tls.Config, proxy *url.URL) *RegistryClient {
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	if tlsConfig != nil {
+		transport.TLSClientConfig = tlsConfig
+	} else if insecure {
+		transport.TLSClientConfig = &tls.Config{InsecureSkipVerify: true}
+	}
+	setTransportProxy(transport, proxy)
+	// same as the docker transport of containers/image
+	if registry == "docker.io" || registry == "index.docker.io" {
+		registry = "registry-1.docker.io"
+	}
+	return &RegistryClient{
+		registry: registry,
+		username: username,
+		password: password,
+		insecure: insecure,
+		client:   &http.Client{Transport: transport},
+		auths:    make(map[string]string),
+		authChan: make(chan int, 1),
+	}
+}
+
+// Do sends a request to the registry, the path may be an absolute url(ex: the location of an upload session),
+// the token of the scope is negotiated if the registry asks for it.
+// The body is sent again after the authorization only if it can be rewound(bytes.Reader, strings.Reader etc.)
+func (c *RegistryClient) Do(ctx context.Context, method string, path string, scope string, header http.Header, body io.Reader) (*http.Response, error) {
+	if err := c.detectScheme(ctx); err != nil {
+		return nil, err
+	}
+
+	target := path
+	if !strings.HasPrefix(path, "http://") && !strings.HasPrefix(path, "https://") {
+		target = c.scheme + "://" + c.registry + path
+	}
+	req, err := http.NewRequestWithContext(ctx, method, target, body)
+	if err != nil {
+		return nil, err
+	}
+	for k, v := range header {
+		req.Header[k] = v
+	}
+	if auth := c.getAuth(scope); auth != "" {
+		req.Header.Set("Authorization", auth)
+	}
+
+	resp, err := c.client.Do(req)
+	if err != nil || resp.StatusCode != http.StatusUnauthorized {
+		return resp, err
+	}
+
+	challenge := resp.Header.Get("WWW-Authenticate")
+	if challenge == "" || (body != nil && req.GetBody == nil) {
+		return resp, nil
+	}
+	resp.Body.Close()
+
+	auth, err := c.authorize(ctx, challenge, scope)
+	if err != nil {
+		return nil, err
+	}
+	retry := req.Clone(ctx)
+	if body != nil {
+		retry.Body, err = req.GetBody()
+		if err != nil {
+			return nil, err
+		}
+	}
+	retry.Header.Set("Authorization", auth)
+	return c.client.Do(retry)
+}
+
+// GetManifest gets the manifest of the reference(tag or digest) and its media type, all the types supported by
+// containers/image are accepted. A manifest referred by the digest is verified
+func (c *RegistryClient) GetManifest(ctx context.Context, repository string, reference string) ([]byte, string, error) {
+	header := http.Header{}
+	header.Set("Accept", strings.Join(manifest.DefaultRequestedManifestMIMETypes, ", "))
+	resp, err := c.Do(ctx, http.MethodGet, "/v2/"+repository+"/manifests/"+reference, "repository:"+repository+":pull", header, nil)
+	if err != nil {
+		return nil, "", err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, "", NewRegistryError(resp)
+	}
+	defer resp.Body.Close()
+
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, "", err
+	}
+	if d, err := digest.Parse(reference); err == nil {
+		matches, err := manifest.MatchesDigest(body, d)
+		if err != nil {
+			return nil, "", err
+		}
+		if !matches {
+			return nil, "", fmt.Errorf("manifest %s/%s@%s does not match the digest", c.registry, repository, d)
+		}
+	}
+
+	mimeType, _, err := mime.ParseMediaType(resp.Header.Get("Content-Type"))
+	if err != nil {
+		mimeType = manifest.GuessMIMEType(body)
+	}
+	return body, manifest.NormalizedMIMEType(mimeType), nil
+}
+
+// GetBlob gets the stream of a blob from the offset, the size of the rest stream is returned, -1 if unknown
+func (c *RegistryClient) GetBlob(ctx context.Context, repository string, d digest.Digest, offset int64) (io.ReadCloser, int64, error) {
+	header := http.Header{}
+	if offset > 0 {
+		header.Set("Range", fmt.Sprintf("bytes=%d-", offset))
+	}
+	resp, err := c.Do(ctx, http.MethodGet, "/v2/"+repository+"/blobs/"+d.String(), "repository:"+repository+":pull", header, nil)
+	if err != nil {
+		return nil, -1, err
+	}
+
+	switch resp.StatusCode {
+	case http.StatusPartialContent:
+		var start int64
+		if _, err := fmt.Sscanf(resp.Header.Get("Content-Range"), "bytes %d-", &start); err != nil || start != offset {
+			resp.Body.Close()
+			return nil, -1, fmt.Errorf("unexpected content range %q of blob %s, expect bytes from %v", resp.Header.Get("Content-Range"), d, offset)
+		}
+		return resp.Body, resp.ContentLength, nil
+	case http.StatusOK:
+		// the registry ignores the range, skip the bytes we already have
+		if offset > 0 {
+			if _, err := io.CopyN(ioutil.Discard, resp.Body, offset); err != nil {
+				resp.Body.Close()
+				return nil, -1, err
+			}
+		}
+		size := resp.ContentLength
+		if size > 0 {
+			size = size - offset
+		}
+		return resp.Body, size, nil
+	default:
+		return nil, -1, NewRegistryError(resp)
+	}
+}
+
+// SupportsRange probes if the registry serves the "Range" request of the blob by reading its first byte
+func (c *RegistryClient) SupportsRange(ctx context.Context, repository string, d digest.Digest) (bool, error) {
+	header := http.Header{}
+	header.Set("Range", "bytes=0-0")
+	resp, err := c.Do(ctx, http.MethodGet, "/v2/"+repository+"/blobs/"+d.String(), "repository:"+repository+":pull", header, nil)
+	if err != nil {
+		return false, err
+	}
+	switch resp.StatusCode {
+	case http.StatusPartialContent:
+		resp.Body.Close()
+		return true, nil
+	case http.StatusOK:
+		resp.Body.Close()
+		return false, nil
+	default:
+		return false, NewRegistryError(resp)
+	}
+}
+
+// GetBlobRange reads the bytes [offset, offset+length) of a blob, an error is returned if the registry ignores the range
+func (c *RegistryClient) GetBlobRange(ctx context.Context, repository string, d digest.Digest, offset int64, length int64) ([]byte, error) {
+	header := http.Header{}
+	header.Set("Range", fmt.Sprintf("bytes=%d-%d", offset, offset+length-1))
+	resp, err := c.Do(ctx, http.MethodGet, "/v2/"+repository+"/blobs/"+d.String(), "repository:"+repository+":pull", header, nil)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusPartialContent {
+		if resp.StatusCode == http.StatusOK {
+			resp.Body.Close()
+			return nil, fmt.Errorf("registry %s does not support the range request of blob %s", c.registry, d)
+		}
+		return nil, NewRegistryError(resp)
+	}
+	defer resp.Body.Close()
+
+	var start int64
+	if _, err := fmt.Sscanf(resp.Header.Get("Content-Range"), "bytes %d-", &start); err != nil || start != offset {
+		return nil, fmt.Errorf("unexpected content range %q of blob %s, expect bytes from %v", resp.Header.Get("Content-Range"), d, offset)
+	}
+	data := make([]byte, length)
+	if _, err := io.ReadFull(resp.Body, data); err != nil {
+		return nil, err
+	}
+	return data, nil
+}
+
+// PutBlobChunked uploads a blob by chunks("PATCH" with "Content-Range"), a chunk broken by network is resent
+// from the offset acknowledged by the upload session
+func (c *RegistryClient) PutBlobChunked(ctx context.Context, repository string, blob io.Reader, d digest.Digest, chunkSize int64) error {
+	scope := "repository:" + repository + ":pull,push"
+	resp, err := c.Do(ctx, http.MethodPost, "/v2/"+repository+"/blobs/uploads/", scope, nil, nil)
+	if err != nil {
+		return err
+	}
+	if resp.StatusCode != http.StatusAccepted {
+		return NewRegistryError(resp)
+	}
+	resp.Body.Close()
+	location := resp.Header.Get("Location")
+	if location == "" {
+		return fmt.Errorf("no upload location returned by %s", c.registry)
+	}
+
+	chunk := make([]byte, chunkSize)
+	var offset int64
+	for {
+		n, rerr := io.ReadFull(blob, chunk)
+		if rerr != nil && rerr != io.EOF && rerr != io.ErrUnexpectedEOF {
+			return rerr
+		}
+		if n > 0 {
+			location, err = c.patchChunk(ctx, location, scope, chunk[:n], offset)
+			if err != nil {
+				return err
+			}
+			offset = offset + int64(n)
+		}
+		if rerr != nil {
+			break
+		}
+	}
+
+	u, err := url.Parse(location)
+	if err != nil {
+		return err
+	}
+	query := u.Query()
+	query.Set("digest", d.String())
+	u.RawQuery = query.Encode()
+	resp, err = c.Do(ctx, http.MethodPut, u.String(), scope, nil, nil)
+	if err != nil {
+		return err
+	}
+	if resp.StatusCode != http.StatusCreated {
+		return NewRegistryError(resp)
+	}
+	resp.Body.Close()
+	return nil
+}
+
+// patchChunk sends a chunk which begins at the offset of the blob, the upload status is queried after a failure
+// and only the part not acknowledged is sent again, the new location of the upload session is returned
+func (c *RegistryClient) patchChunk(ctx context.Context, location string, scope string, chunk []byte, offset int64) (string, error) {
+	var sent int64
+	var err error
+	for resumed := 0; ; resumed++ {
+		if resumed > 0 {
+			if resumed > BLOB_RESUME || ctx.Err() != nil {
+				return location, err
+			}
+			log.Warnf("Upload chunk %v-%v to %s failed: %v, resume %v/%v", offset+sent, offset+int64(len(chunk))-1, c.registry, err, resumed, BLOB_RESUME)
+			time.Sleep(time.Duration(resumed) * time.Second)
+
+			var end int64
+			location, end, err = c.uploadStatus(ctx, location, scope)
+			if err != nil {
+				continue
+			}
+			// the registry has got the bytes [0, end]
+			if end+1 < offset || end+1 > offset+int64(len(chunk)) {
+				return location, fmt.Errorf("upload session has %v bytes which is out of the chunk %v-%v", end+1, offset, offset+int64(len(chunk))-1)
+			}
+			sent = end + 1 - offset
+			if sent == int64(len(chunk)) {
+				return location, nil
+			}
+		}
+
+		header := http.Header{}
+		header.Set("Content-Type", "application/octet-stream")
+		header.Set("Content-Range", fmt.Sprintf("%d-%d", offset+sent, offset+int64(len(chunk))-1))
+		var resp *http.Response
+		resp, err = c.Do(ctx, http.MethodPatch, location, scope, header, bytes.NewReader(chunk[sent:]))
+		if err != nil {
+			continue
+		}
+		if resp.StatusCode != http.StatusAccepted {
+			err = NewRegistryError(resp)
+			// the session is gone or not permitted, it can not be resumed
+			if resp.StatusCode < http.StatusInternalServerError && resp.StatusCode != http.StatusRequestedRangeNotSatisfiable {
+				return location, err
+			}
+			continue
+		}
+		resp.Body.Close()
+		if l := resp.Header.Get("Location"); l != "" {
+			location = l
+		}
+		return location, nil
+	}
+}
+
+// uploadStatus gets the last offset of the upload session, -1 if nothing uploaded
+func (c *RegistryClient) uploadStatus(ctx context.Context, location string, scope string) (string, int64, error) {
+	resp, err := c.Do(ctx, http.MethodGet, location, scope, nil, nil)
+	if err != nil {
+		return location, -1, err
+	}
+	if resp.StatusCode != http.StatusNoContent {
+		return location, -1, NewRegistryError(resp)
+	}
+	resp.Body.Close()
+	if l := resp.Header.Get("Location"); l != "" {
+		location = l
+	}
+
+	// "0-0" is returned for an empty session by the docker distribution, a session with one byte is rare
+	var start, end int64
+	if _, err := fmt.Sscanf(resp.Header.Get("Range"), "%d-%d", &start, &end); err != nil || end == 0 {
+		return location, -1, nil
+	}
+	return location, end, nil
+}
+
+// GetCatalog lists the repositories of the registry by the "_catalog" API, the next pages are followed by the "Link"
+// header. Most registries restrict the API, ex: Harbor only serves it to the system administrators
+func (c *RegistryClient) GetCatalog(ctx context.Context) ([]string, error) {
+	var repositories []string
+	path := fmt.Sprintf("/v2/_catalog?n=%d", CATALOG_PAGE_SIZE)
+	for path != "" {
+		resp, err := c.Do(ctx, http.MethodGet, path, "registry:catalog:*", nil, nil)
+		if err != nil {
+			return nil, err
+		}
+		if resp.StatusCode != http.StatusOK {
+			return nil, NewRegistryError(resp)
+		}
+		var page struct {
+			Repositories []string `json:"repositories"`
+		}
+		err = json.NewDecoder(resp.Body).Decode(&page)
+		resp.Body.Close()
+		if err != nil {
+			return nil, err
+		}
+		repositories = append(repositories, page.Repositories...)
+		path = ""
+		if len(page.Repositories) > 0 {
+			path = nextLink(resp.Header.Get("Link"))
+		}
+	}
+	return repositories, nil
+}
+
+// GetTags lists all the tags of the repository by the "tags/list" API, the pages are followed by the "Link" header
+func (c *RegistryClient) GetTags(ctx context.Context, repository string) ([]string, error) {
+	var tags []string
+	path := "/v2/" + repository + "/tags/list"
+	for path != "" {
+		resp, err := c.Do(ctx, http.MethodGet, path, "repository:"+repository+":pull", nil, nil)
+		if err != nil {
+			return nil, err
+		}
+		if resp.StatusCode != http.StatusOK {
+			return nil, NewRegistryError(resp)
+		}
+		var page struct {
+			Tags []string `json:"tags"`
+		}
+		err = json.NewDecoder(resp.Body).Decode(&page)
+		resp.Body.Close()
+		if err != nil {
+			return nil, err
+		}
+		tags = append(tags, page.Tags...)
+		path = ""
+		if len(page.Tags) > 0 {
+			path = nextLink(resp.Header.Get("Link"))
+		}
+	}
+	return tags, nil
+}
+
+// nextLink returns the url of the next page in the "Link" header, ex: </v2/_catalog?last=b&n=100>; rel="next"
+func nextLink(link string) string {
+	for _, l := range strings.Split(link, ",") {
+		parts := strings.Split(l, ";")
+		if len(parts) < 2 {
+			continue
+		}
+		for _, p := range parts[1:] {
+			if strings.ReplaceAll(strings.TrimSpace(p), " ", "") == `rel="next"` {
+				return strings.Trim(strings.TrimSpace(parts[0]), "<>")
+			}
+		}
+	}
+	return ""
+}
+
+// NewRegistryError reads the response and closes the body
+func NewRegistryError(resp *http.Response) error {
+	defer resp.Body.Close()
+	body, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 4096))
+	return &RegistryError{
+		StatusCode: resp.StatusCode,
+		Status:     resp.Status,
+		Header:     resp.Header,
+		Message:    strings.TrimSpace(string(body)),
+		Delay:      parseRetryAfter(resp.Header.Get("Retry-After")),
+	}
+}
+
+// the registry of an insecure target may be served by http, try https first like docker does
+func (c *RegistryClient) detectScheme(ctx context.Context) error {
+	c.authChan <- 1
+	defer func() {
+		<-c.authChan
+	}()
+
+	if c.scheme != "" {
+		return nil
+	}
+	if !c.insecure {
+		c.scheme = "https"
+		return nil
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, "https://"+c.registry+"/v2/", nil)
+	if err != nil {
+		return err
+	}
+	resp, err := c.client.Do(req)
+	if err != nil {
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		c.scheme = "http"
+		return nil
+	}
+	resp.Body.Close()
+	c.scheme = "https"
+	return nil
+}
+
+func (c *RegistryClient) getAuth(scope string) string {
+	c.authChan <- 1
+	defer func() {
+		<-c.authChan
+	}()
+
+	if auth, ok := c.auths[scope]; ok {
+		return auth
+	}
+	return c.auths[""]
+}
+
+// authorize handles the "Basic" and "Bearer" challenges of the registry token authentication
+func (c *RegistryClient) authorize(ctx context.Context, challenge string, scope string) (string, error) {
+	authType, params := parseChallenge(challenge)
+
+	var auth string
+	switch authType {
+	case "basic":
+		if c.username == "" {
+			return "", fmt.Errorf("registry %s requires basic authentication", c.registry)
+		}
+		if c.username == IDENTITY_TOKEN_USER {
+			return "", fmt.Errorf("registry %s requires basic authentication, the identity token can not be used, login with the username and password instead", c.registry)
+		}
+		auth = "Basic " + base64.StdEncoding.EncodeToString([]byte(c.username+":"+c.password))
+		scope = ""
+	case "bearer":
+		token, err := c.fetchToken(ctx, params, scope)
+		if err != nil {
+			return "", err
+		}
+		auth = "Bearer " + token
+	default:
+		return "", fmt.Errorf("unsupported authentication challenge: %s", challenge)
+	}
+
+	c.authChan <- 1
+	c.auths[scope] = auth
+	<-c.authChan
+	return auth, nil
+}
+
+func (c *RegistryClient) fetchToken(ctx context.Context, params map[string]string, scope string) (string, error) {
+	realm, err := url.Parse(params["realm"])
+	if err != nil || params["realm"] == "" {
+		return "", fmt.Errorf("invalid token realm: %s", params["realm"])
+	}
+
+	query := realm.Query()
+	if params["service"] != "" {
+		query.Set("service", params["service"])
+	}
+	scopes := strings.Fields(scope)
+	if params["scope"] != "" && !strings.Contains(" "+scope+" ", " "+params["scope"]+" ") {
+		scopes = append(scopes, params["scope"])
+	}
+	for _, s := range scopes {
+		query.Add("scope", s)
+	}
+	realm.RawQuery = query.Encode()
+
+	var req *http.Request
+	if c.username == IDENTITY_TOKEN_USER {
+		// the identity token is an OAuth2 refresh token, exchanged for the access token by a POST like docker does
+		form := url.Values{}
+		form.Set("grant_type", "refresh_token")
+		form.Set("refresh_token", c.password)
+		form.Set("client_id", "image-transmit")
+		form.Set("service", params["service"])
+		form.Set("scope", strings.Join(scopes, " "))
+		req, err = http.NewRequestWithContext(ctx, http.MethodPost, params["realm"], strings.NewReader(form.Encode()))
+		if err != nil {
+			return "", err
+		}
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	} else {
+		req, err = http.NewRequestWithContext(ctx, http.MethodGet, realm.String(), nil)
+		if err != nil {
+			return "", err
+		}
+		if c.username != "" {
+			req.SetBasicAuth(c.username, c.password)
+		}
+	}
+	resp, err := c.client.Do(req)
+	if err != nil {
+		return "", err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return "", NewRegistryError(resp)
+	}
+	defer resp.Body.Close()
+
+	var token struct {
+		Token       string `json:"token"`
+		AccessToken string `json:"access_token"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&token); err != nil {
+		return "", err
+	}
+	if token.Token == "" {
+		token.Token = token.AccessToken
+	}
+	if token.Token == "" {
+		return "", fmt.Errorf("no token returned by %s", realm.Host)
+	}
+	return token.Token, nil
+}
+
+// parseChallenge parses a WWW-Authenticate header like: Bearer realm="https://auth.docker.io/token",service="registry.docker.io"
+func parseChallenge(challenge string) (string, map[string]string) {
+	params := make(map[string]string)
+	seg := strings.SplitN(strings.TrimSpace(challenge), " ", 2)
+	authType := strings.ToLower(seg[0])
+	if len(seg) < 2 {
+		return authType, params
+	}
+
+	rest := seg[1]
+	for len(rest) > 0 {
+		rest = strings.TrimLeft(rest, " ,")
+		eq := strings.Index(rest, "=")
+		if eq < 0 {
+			break
+		}
+		key := strings.ToLower(strings.TrimSpace(rest[:eq]))
+		rest = rest[eq+1:]
+		var value string
+		if strings.HasPrefix(rest, "\"") {
+			end := strings.Index(rest[1:], "\"")
+			if end < 0 {
+				value, rest = rest[1:], ""
+			} else {
+				value, rest = rest[1:end+1], rest[end+2:]
+			}
+		} else {
+			end := strings.Index(rest, ",")
+			if end < 0 {
+				value, rest = rest, ""
+			} else {
+				value, rest = rest[:end], rest[end+1:]
+			}
+		}
+		params[key] = value
+	}
+	return authType, params
+}
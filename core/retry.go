@@ -0,0 +1,55 @@
+package core
+
+import (
+	"time"
+
+	"github.com/containers/image/v5/types"
+	"github.com/pkg/errors"
+)
+
+var (
+	// BLOB_RETRIES is the max times to retry a failed blob inside a task, before the whole task fails
+	BLOB_RETRIES = 3
+)
+
+// noRetryError marks an error which must not be retried at the blob level, ex: an archive is half written
+type noRetryError struct {
+	error
+}
+
+func (e *noRetryError) Unwrap() error {
+	return e.error
+}
+
+// RetryBlob runs the transfer of a blob again after a failure with a jittered backoff, up to BLOB_RETRIES times,
+// so a bad connection costs one extra blob instead of the whole image.
+// The permanent errors, the noRetryError and the cancellation are returned at once.
+func RetryBlob(ctx *TaskContext, url string, b types.BlobInfo, transfer func() error) error {
+	var failures int
+	for {
+		err := transfer()
+		if err == nil {
+			if failures > 0 {
+				ctx.Report(I18n.Sprintf("Blob retries"), I18n.Sprintf("%s %s succeeded after %v attempts", url, ShortenString(b.Digest.String(), 19), failures+1))
+			}
+			return nil
+		}
+
+		var noRetry *noRetryError
+		if failures >= BLOB_RETRIES || ctx.Cancel() || IsPermanentError(err) || errors.As(err, &noRetry) {
+			if failures > 0 {
+				ctx.Report(I18n.Sprintf("Blob retries"), I18n.Sprintf("%s %s failed after %v attempts", url, ShortenString(b.Digest.String(), 19), failures+1))
+			}
+			return err
+		}
+
+		wait := RetryBackoff(failures, RetryAfter(err))
+		failures++
+		ctx.Info(I18n.Sprintf("Transfer blob %s(%v) of %s failed: %v, retry %v/%v in %v", ShortenString(b.Digest.String(), 19), FormatByteSize(b.Size), url, err, failures, BLOB_RETRIES, wait.Round(100*time.Millisecond)))
+		select {
+		case <-time.After(wait):
+		case <-ctx.Context.Done():
+			return err
+		}
+	}
+}
@@ -0,0 +1,209 @@
+package core
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+
+	"github.com/containers/image/v5/manifest"
+	"github.com/containers/image/v5/pkg/compression"
+	"github.com/containers/image/v5/types"
+	"github.com/opencontainers/go-digest"
+	"github.com/pkg/errors"
+)
+
+// the schema1 policies of a target, for the legacy images in docker schema1 manifest
+const (
+	// push the schema1 manifest, convert it to schema2 if the destination refuses it, the default
+	SCHEMA1_AUTO = "auto"
+	// always convert to schema2
+	SCHEMA1_CONVERT = "convert"
+	// never convert, the image fails if the destination refuses it
+	SCHEMA1_KEEP = "keep"
+)
+
+var (
+	// the layers inspected during the run, the schema1 manifest has no layer size and the schema2 config needs the diff ids
+	schema1Layers     = make(map[digest.Digest]schema1Layer)
+	schema1LayersChan = make(chan int, 1)
+)
+
+type schema1Layer struct {
+	size   int64
+	diffID digest.Digest
+}
+
+// checkSchema1Policy validates the schema1 policy of a repo
+func checkSchema1Policy(policy string) error {
+	switch policy {
+	case "", SCHEMA1_AUTO, SCHEMA1_CONVERT, SCHEMA1_KEEP:
+		return nil
+	}
+	return fmt.Errorf("invalid schema1 policy %s, should be one of %s, %s, %s", policy, SCHEMA1_AUTO, SCHEMA1_CONVERT, SCHEMA1_KEEP)
+}
+
+// GetSchema1Policy returns the schema1 policy of the destination
+func (i *ImageDestination) GetSchema1Policy() string {
+	if i.schema1 == "" {
+		return SCHEMA1_AUTO
+	}
+	return i.schema1
+}
+
+// IsSchema1 checks if the manifest type is docker schema1, signed or not
+func IsSchema1(manifestType string) bool {
+	return manifestType == manifest.DockerV2Schema1MediaType || manifestType == manifest.DockerV2Schema1SignedMediaType
+}
+
+// IsManifestRejected checks if the destination refuses the type of the manifest, but may accept another type
+func IsManifestRejected(err error) bool {
+	var rejected types.ManifestTypeRejectedError
+	if errors.As(err, &rejected) {
+		return true
+	}
+	var regErr *RegistryError
+	if errors.As(err, &regErr) {
+		return regErr.StatusCode == http.StatusUnsupportedMediaType
+	}
+	if m := statusCodePattern.FindStringSubmatch(err.Error()); m != nil {
+		return m[2] == "415"
+	}
+	return false
+}
+
+// Schema1Converter converts a schema1 manifest to schema2 like "docker pull" does: the config is built from the
+// v1Compatibility history, the empty layers are dropped, the layers are pulled once to get their sizes and diff ids
+type Schema1Converter struct {
+	ctx    *TaskContext
+	is     *ImageSource
+	srcUrl string
+}
+
+// NewSchema1Converter creates a Schema1Converter pulling the layers from the source
+func NewSchema1Converter(ctx *TaskContext, is *ImageSource, srcUrl string) *Schema1Converter {
+	return &Schema1Converter{
+		ctx:    ctx,
+		is:     is,
+		srcUrl: srcUrl,
+	}
+}
+
+// Convert returns the schema2 manifest and config of the schema1 manifest
+func (c *Schema1Converter) Convert(manifestByte []byte) ([]byte, []byte, error) {
+	s1, err := manifest.Schema1FromManifest(manifestByte)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	var diffIDs []digest.Digest
+	var layers []manifest.Schema2Descriptor
+	for _, l := range s1.LayerInfos() {
+		if l.EmptyLayer {
+			continue
+		}
+		layer, err := c.inspectLayer(l.BlobInfo)
+		if err != nil {
+			return nil, nil, err
+		}
+		diffIDs = append(diffIDs, layer.diffID)
+		layers = append(layers, manifest.Schema2Descriptor{
+			MediaType: manifest.DockerV2Schema2LayerMediaType,
+			Size:      layer.size,
+			Digest:    l.Digest,
+		})
+	}
+
+	configByte, err := s1.ToSchema2Config(diffIDs)
+	if err != nil {
+		return nil, nil, err
+	}
+	config := manifest.Schema2Descriptor{
+		MediaType: manifest.DockerV2Schema2ConfigMediaType,
+		Size:      int64(len(configByte)),
+		Digest:    digest.FromBytes(configByte),
+	}
+	newManifestByte, err := manifest.Schema2FromComponents(config, layers).Serialize()
+	if err != nil {
+		return nil, nil, err
+	}
+	c.ctx.Info(I18n.Sprintf("Convert the schema1 manifest of %s to schema2, config %s", c.srcUrl, ShortenString(config.Digest.String(), 19)))
+	return newManifestByte, configByte, nil
+}
+
+// inspectLayer pulls a layer to get its size and diff id, the layer inspected before is reused
+func (c *Schema1Converter) inspectLayer(b types.BlobInfo) (schema1Layer, error) {
+	schema1LayersChan <- 1
+	layer, ok := schema1Layers[b.Digest]
+	<-schema1LayersChan
+	if ok {
+		return layer, nil
+	}
+
+	if !c.ctx.AcquireStream() {
+		return layer, errors.New(I18n.Sprintf("User cancelled..."))
+	}
+	defer c.ctx.ReleaseStream()
+
+	err := RetryBlob(c.ctx, c.srcUrl, b, func() error {
+		blob, _, err := c.is.GetABlob(b)
+		if err != nil {
+			return WrapError(err, I18n.Sprintf("Get blob %s(%v) from %s failed: %v", b.Digest.String(), FormatByteSize(b.Size), c.srcUrl, err))
+		}
+		defer blob.Close()
+		layer, err = diffLayer(NewRateLimitReader(c.ctx.Context, blob, c.is.GetRateLimiter()))
+		if err != nil {
+			return WrapError(err, I18n.Sprintf("Get blob %s(%v) from %s failed: %v", b.Digest.String(), FormatByteSize(b.Size), c.srcUrl, err))
+		}
+		return nil
+	})
+	if err != nil {
+		return layer, err
+	}
+	c.ctx.Debug(I18n.Sprintf("Layer %s(%v) has the diff id %s", ShortenString(b.Digest.String(), 19), FormatByteSize(layer.size), ShortenString(layer.diffID.String(), 19)))
+
+	schema1LayersChan <- 1
+	schema1Layers[b.Digest] = layer
+	<-schema1LayersChan
+	return layer, nil
+}
+
+// diffLayer reads a layer to the end, returns its size and the digest of the uncompressed content
+func diffLayer(reader io.Reader) (schema1Layer, error) {
+	counter := NewReaderSumWrapper(reader)
+	_, decompressor, uncompressed, err := compression.DetectCompressionFormat(counter)
+	if err != nil {
+		return schema1Layer{}, err
+	}
+	if decompressor != nil {
+		rc, err := decompressor(uncompressed)
+		if err != nil {
+			return schema1Layer{}, err
+		}
+		defer rc.Close()
+		uncompressed = rc
+	}
+	digester := digest.Canonical.Digester()
+	if _, err := io.Copy(digester.Hash(), uncompressed); err != nil {
+		return schema1Layer{}, err
+	}
+	// the compressed stream may have trailing bytes, read to the end so that the source verifies the digest
+	if _, err := io.Copy(ioutil.Discard, counter); err != nil {
+		return schema1Layer{}, err
+	}
+	return schema1Layer{size: counter.Size, diffID: digester.Digest()}, nil
+}
+
+// pushConfig pushes the config built by the conversion if the destination does not have it
+func pushConfig(id *ImageDestination, configByte []byte) error {
+	config := types.BlobInfo{
+		Digest: digest.FromBytes(configByte),
+		Size:   int64(len(configByte)),
+	}
+	exist, err := id.CheckBlobExist(config)
+	if err != nil || exist {
+		return err
+	}
+	return id.PutABlob(ioutil.NopCloser(bytes.NewReader(configByte)), config)
+}
@@ -0,0 +1,347 @@
+package core
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/base64"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"regexp"
+	"strings"
+	"sync"
+
+	log "github.com/cihub/seelog"
+	"golang.org/x/crypto/scrypt"
+	"gopkg.in/yaml.v2"
+)
+
+var (
+	// SECRET_KEY_ENV holds the key to encrypt/decrypt the secrets in cfg.yaml
+	SECRET_KEY_ENV = "IMAGE_TRANSMIT_KEY"
+	// SECRET_KEY_FILE_ENV holds the path of the key file, the default one is SECRET_KEY_FILE
+	SECRET_KEY_FILE_ENV = "IMAGE_TRANSMIT_KEY_FILE"
+	// the key file is kept out of the data dir, so that copying the data dir does not copy the key
+	SECRET_KEY_FILE = defaultSecretKeyFile()
+
+	// the secret lines in cfg.yaml, ex: "  password: xxx # comment" or "- token: 'xxx'",
+	// the proxy is encrypted only if it has a password
+	secretLinePattern = regexp.MustCompile(`^(\s*(?:-\s+)?(password|secret|token|proxy)\s*:[ \t]*)(.*)$`)
+
+	warnKeyFileOnce sync.Once
+
+	// the derived keys of each salt, a cfg.yaml with many secrets is decrypted without running scrypt for each of them
+	derivedKeys     = make(map[string][]byte)
+	derivedKeysLock sync.Mutex
+)
+
+const (
+	// the scrypt parameters recommended for the interactive logins
+	secretSaltSize = 16
+	scryptN        = 32768
+	scryptR        = 8
+	scryptP        = 1
+)
+
+// IsEncrypted checks if the value is in the "ENC(...)" format
+func IsEncrypted(value string) bool {
+	return strings.HasPrefix(value, "ENC(") && strings.HasSuffix(value, ")")
+}
+
+// EncryptSecret encrypts a value with AES-GCM and returns it in the "ENC(...)" format, the AES key is derived from
+// the secret key by scrypt with a random salt, the value is encoded as base64(salt + nonce + sealed)
+func EncryptSecret(value string) (string, error) {
+	salt := make([]byte, secretSaltSize)
+	if _, err := io.ReadFull(rand.Reader, salt); err != nil {
+		return "", err
+	}
+	gcm, err := secretCipher(salt, true)
+	if err != nil {
+		return "", err
+	}
+	nonce := make([]byte, gcm.NonceSize())
+	if _, err := io.ReadFull(rand.Reader, nonce); err != nil {
+		return "", err
+	}
+	sealed := gcm.Seal(append(salt, nonce...), nonce, []byte(value), nil)
+	return "ENC(" + base64.StdEncoding.EncodeToString(sealed) + ")", nil
+}
+
+// DecryptSecret decrypts a value in the "ENC(...)" format, other values are returned as they are
+func DecryptSecret(value string) (string, error) {
+	if !IsEncrypted(value) {
+		return value, nil
+	}
+	sealed, err := base64.StdEncoding.DecodeString(value[4 : len(value)-1])
+	if err != nil {
+		return "", err
+	}
+	if len(sealed) < secretSaltSize {
+		return "", fmt.Errorf("invalid encrypted value: %s", value)
+	}
+	gcm, err := secretCipher(sealed[:secretSaltSize], false)
+	if err != nil {
+		return "", err
+	}
+	sealed = sealed[secretSaltSize:]
+	if len(sealed) < gcm.NonceSize() {
+		return "", fmt.Errorf("invalid encrypted value: %s", value)
+	}
+	plain, err := gcm.Open(nil, sealed[:gcm.NonceSize()], sealed[gcm.NonceSize():], nil)
+	if err != nil {
+		return "", fmt.Errorf("decrypt value failed, the key may be wrong: %v", err)
+	}
+	return string(plain), nil
+}
+
+// DecryptSecrets decrypts the passwords and the proxies of the repositories and the dingtalk tokens and secrets
+func (c *YamlCfg) DecryptSecrets() error {
+	var secrets []*string
+	for i := range c.SrcRepos {
+		secrets = append(secrets, &c.SrcRepos[i].Password, &c.SrcRepos[i].Proxy)
+	}
+	for i := range c.DstRepos {
+		secrets = append(secrets, &c.DstRepos[i].Password, &c.DstRepos[i].Proxy)
+	}
+	for i := range c.DingTalk {
+		secrets = append(secrets, &c.DingTalk[i].Token, &c.DingTalk[i].Secret)
+	}
+
+	for _, s := range secrets {
+		plain, err := DecryptSecret(*s)
+		if err != nil {
+			return err
+		}
+		*s = plain
+	}
+	return nil
+}
+
+// EncryptConfigFile encrypts the plain passwords, tokens, secrets and proxy passwords of a cfg.yaml in place,
+// the comments and the layout are kept, returns the count of the encrypted values. The values are decoded as yaml
+// scalars, the file is not written if a value can not be rewritten safely or the result does not load the same config
+func EncryptConfigFile(filename string) (int, error) {
+	b, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return 0, err
+	}
+
+	lines := strings.Split(string(b), "\n")
+	count := 0
+	for i, line := range lines {
+		m := secretLinePattern.FindStringSubmatch(strings.TrimSuffix(line, "\r"))
+		if m == nil {
+			continue
+		}
+		raw, trailing, err := splitScalar(m[3])
+		if err != nil {
+			return 0, fmt.Errorf("line %d: can not encrypt the %s safely, encrypt it by -value and fill it in: %v", i+1, m[2], err)
+		}
+		if raw == "" {
+			continue
+		}
+		var scalar struct {
+			Value string `yaml:"value"`
+		}
+		if err := yaml.Unmarshal([]byte("value: "+raw), &scalar); err != nil {
+			return 0, fmt.Errorf("line %d: can not encrypt the %s safely, encrypt it by -value and fill it in: %v", i+1, m[2], err)
+		}
+		value := scalar.Value
+		if value == "" || IsEncrypted(value) {
+			continue
+		}
+		if m[2] == "proxy" {
+			if u, err := ParseProxy(value); err != nil || u.User == nil {
+				continue
+			} else if _, ok := u.User.Password(); !ok {
+				continue
+			}
+		}
+		encrypted, err := EncryptSecret(value)
+		if err != nil {
+			return 0, err
+		}
+		lines[i] = m[1] + encrypted + trailing
+		if strings.HasSuffix(line, "\r") {
+			lines[i] = lines[i] + "\r"
+		}
+		count++
+	}
+
+	if count == 0 {
+		return 0, nil
+	}
+	encrypted := []byte(strings.Join(lines, "\n"))
+	if err := checkEncryptedConfig(b, encrypted); err != nil {
+		return 0, err
+	}
+	info, err := os.Stat(filename)
+	if err != nil {
+		return 0, err
+	}
+	return count, ioutil.WriteFile(filename, encrypted, info.Mode())
+}
+
+// splitScalar splits the rest of a "key: value" line to the raw scalar and the trailing spaces and comment,
+// only the single line scalars are supported: plain, 'single quoted' and "double quoted"
+func splitScalar(rest string) (string, string, error) {
+	if strings.TrimSpace(rest) == "" || strings.HasPrefix(rest, "#") {
+		return "", rest, nil
+	}
+	end := -1
+	switch rest[0] {
+	case '"':
+		for i := 1; i < len(rest); i++ {
+			if rest[i] == '\\' {
+				i++
+			} else if rest[i] == '"' {
+				end = i + 1
+				break
+			}
+		}
+	case '\'':
+		for i := 1; i < len(rest); i++ {
+			if rest[i] != '\'' {
+				continue
+			}
+			if i+1 < len(rest) && rest[i+1] == '\'' {
+				i++
+				continue
+			}
+			end = i + 1
+			break
+		}
+	case '|', '>', '[', '{', '&', '*', '!', '%', '@', '`':
+		return "", "", fmt.Errorf("unsupported yaml value %s", rest)
+	default:
+		// a comment of a plain scalar starts with " #", the "#" inside is a part of the value
+		end = len(rest)
+		for i := 1; i < len(rest); i++ {
+			if rest[i] == '#' && (rest[i-1] == ' ' || rest[i-1] == '\t') {
+				end = i
+				break
+			}
+		}
+		end = len(strings.TrimRight(rest[:end], " \t"))
+		return rest[:end], rest[end:], nil
+	}
+	if end < 0 {
+		return "", "", fmt.Errorf("unterminated quoted value %s", rest)
+	}
+	trailing := rest[end:]
+	if t := strings.TrimLeft(trailing, " \t"); t != "" && (!strings.HasPrefix(t, "#") || t == trailing) {
+		return "", "", fmt.Errorf("unexpected %s after the quoted value", t)
+	}
+	return rest[:end], trailing, nil
+}
+
+// checkEncryptedConfig makes sure that the encrypted cfg.yaml loads the same config as the original one
+func checkEncryptedConfig(original []byte, encrypted []byte) error {
+	var before, after YamlCfg
+	if err := yaml.Unmarshal(original, &before); err != nil {
+		return err
+	}
+	if err := yaml.Unmarshal(encrypted, &after); err != nil {
+		return fmt.Errorf("the encrypted file is not valid, nothing is written: %v", err)
+	}
+	if err := before.DecryptSecrets(); err != nil {
+		return err
+	}
+	if err := after.DecryptSecrets(); err != nil {
+		return err
+	}
+	if !reflect.DeepEqual(before, after) {
+		return fmt.Errorf("the encrypted file does not load the same config, nothing is written, encrypt the values by -value and fill them in")
+	}
+	return nil
+}
+
+// SecretKeyFile returns the path of the key file
+func SecretKeyFile() string {
+	if keyFile := os.Getenv(SECRET_KEY_FILE_ENV); keyFile != "" {
+		return keyFile
+	}
+	return SECRET_KEY_FILE
+}
+
+// KeyFileInDataDir checks if the key file is in the data dir, where it is copied together with cfg.yaml
+func KeyFileInDataDir(keyFile string) bool {
+	home, err := filepath.Abs(HOME)
+	if err != nil {
+		return false
+	}
+	file, err := filepath.Abs(keyFile)
+	if err != nil {
+		return false
+	}
+	rel, err := filepath.Rel(home, file)
+	return err == nil && rel != ".." && !strings.HasPrefix(rel, ".."+string(filepath.Separator))
+}
+
+func defaultSecretKeyFile() string {
+	home, err := os.UserHomeDir()
+	if err != nil || home == "" {
+		return filepath.Join(HOME, "secret.key")
+	}
+	return filepath.Join(home, ".image-transmit", "secret.key")
+}
+
+// secretCipher loads the key from the env or the key file and derives the AES key of the salt,
+// a new key file is generated for encryption if no key found
+func secretCipher(salt []byte, generate bool) (cipher.AEAD, error) {
+	key := os.Getenv(SECRET_KEY_ENV)
+	if key == "" {
+		keyFile := SecretKeyFile()
+		b, err := ioutil.ReadFile(keyFile)
+		if err != nil {
+			if !os.IsNotExist(err) || !generate {
+				return nil, fmt.Errorf("read the secret key failed, set it by env %s or key file %s: %v", SECRET_KEY_ENV, keyFile, err)
+			}
+			random := make([]byte, 32)
+			if _, err := io.ReadFull(rand.Reader, random); err != nil {
+				return nil, err
+			}
+			b = []byte(base64.StdEncoding.EncodeToString(random))
+			os.MkdirAll(filepath.Dir(keyFile), os.ModePerm)
+			if err := ioutil.WriteFile(keyFile, b, 0600); err != nil {
+				return nil, err
+			}
+		}
+		key = strings.TrimSpace(string(b))
+		if KeyFileInDataDir(keyFile) {
+			warnKeyFileOnce.Do(func() {
+				log.Warnf("The secret key file %s is in the data dir %s, anyone copying the data dir gets the key, move it out or set the key by env %s", keyFile, HOME, SECRET_KEY_ENV)
+			})
+		}
+	}
+
+	aesKey, err := deriveKey(key, salt)
+	if err != nil {
+		return nil, err
+	}
+	block, err := aes.NewCipher(aesKey)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// deriveKey derives the 256 bits AES key by scrypt, the keys are cached by the key and the salt
+func deriveKey(key string, salt []byte) ([]byte, error) {
+	id := key + "\x00" + string(salt)
+	derivedKeysLock.Lock()
+	defer derivedKeysLock.Unlock()
+	if aesKey, ok := derivedKeys[id]; ok {
+		return aesKey, nil
+	}
+	aesKey, err := scrypt.Key([]byte(key), salt, scryptN, scryptR, scryptP, 32)
+	if err != nil {
+		return nil, err
+	}
+	derivedKeys[id] = aesKey
+	return aesKey, nil
+}
@@ -0,0 +1,197 @@
+package core
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"sync"
+	"time"
+
+	log "github.com/cihub/seelog"
+	"github.com/opencontainers/go-digest"
+)
+
+var (
+	// SEGMENT_SIZE is the default size of a segment in MB
+	SEGMENT_SIZE = 32
+)
+
+// RangeSupport records if the registries serve the "Range" request, each registry is probed once by its first blob.
+// It is carried by the context of a run(see TaskContext.Reset), so a new run probes again
+type RangeSupport struct {
+	m      sync.Mutex
+	probes map[string]*rangeProbe
+}
+
+type rangeProbe struct {
+	done      chan struct{}
+	supported bool
+	err       error
+}
+
+type rangeSupportKey struct{}
+
+// WithRangeSupport returns a context carrying a new RangeSupport
+func WithRangeSupport(ctx context.Context) context.Context {
+	return context.WithValue(ctx, rangeSupportKey{}, &RangeSupport{
+		probes: make(map[string]*rangeProbe),
+	})
+}
+
+// SupportsRange checks if the registry of the client serves the "Range" request, the result is kept in the
+// RangeSupport of the context, the registry is probed every time if the context has none
+func SupportsRange(ctx context.Context, client *RegistryClient, repository string, d digest.Digest) (bool, error) {
+	r, _ := ctx.Value(rangeSupportKey{}).(*RangeSupport)
+	if r == nil {
+		return client.SupportsRange(ctx, repository, d)
+	}
+
+	r.m.Lock()
+	p, probing := r.probes[client.registry]
+	if !probing {
+		p = &rangeProbe{done: make(chan struct{})}
+		r.probes[client.registry] = p
+	}
+	r.m.Unlock()
+	if probing {
+		select {
+		case <-p.done:
+			return p.supported, p.err
+		case <-ctx.Done():
+			return false, ctx.Err()
+		}
+	}
+
+	// the lock is not held while probing, the other blobs of the registry wait for the result
+	p.supported, p.err = client.SupportsRange(ctx, repository, d)
+	if p.err != nil {
+		// probed again by the next blob
+		r.m.Lock()
+		delete(r.probes, client.registry)
+		r.m.Unlock()
+	} else if !p.supported {
+		log.Warnf("Registry %s does not support the range request, the blobs are downloaded by a single stream", client.registry)
+	}
+	close(p.done)
+	return p.supported, p.err
+}
+
+// SegmentedReader downloads a large blob as several concurrent "Range" segments and returns them in order,
+// at most "parallel" segments are downloading or waiting in memory, so a run takes up to
+// segments * segmentSize * the concurrent blob streams of memory. The digest is not verified here but by the
+// ResumableReader wrapping it, which also continues by a single stream if a segment fails
+type SegmentedReader struct {
+	ctx     context.Context
+	cancel  context.CancelFunc
+	client  *RegistryClient
+	repo    string
+	digest  digest.Digest
+	size    int64
+	segSize int64
+	results []chan segmentResult
+	window  chan int
+	next    int
+	current *bytes.Reader
+	err     error
+}
+
+type segmentResult struct {
+	data []byte
+	err  error
+}
+
+// NewSegmentedReader starts to download the blob of the size by segments of segSize with parallel connections
+func NewSegmentedReader(pCtx context.Context, client *RegistryClient, repository string, d digest.Digest, size int64, segSize int64, parallel int) *SegmentedReader {
+	ctx, cancel := context.WithCancel(pCtx)
+	count := int((size + segSize - 1) / segSize)
+	r := &SegmentedReader{
+		ctx:     ctx,
+		cancel:  cancel,
+		client:  client,
+		repo:    repository,
+		digest:  d,
+		size:    size,
+		segSize: segSize,
+		results: make([]chan segmentResult, count),
+		window:  make(chan int, parallel),
+	}
+	for i := range r.results {
+		r.results[i] = make(chan segmentResult, 1)
+	}
+	go r.schedule()
+	return r
+}
+
+// schedule starts a segment when a slot of the window is free, the slot is released after the segment is read
+func (r *SegmentedReader) schedule() {
+	for idx := range r.results {
+		select {
+		case r.window <- 1:
+		case <-r.ctx.Done():
+			return
+		}
+		go func(idx int) {
+			data, err := r.fetch(idx)
+			r.results[idx] <- segmentResult{data: data, err: err}
+		}(idx)
+	}
+}
+
+// fetch downloads a segment, the broken one is downloaded again up to BLOB_RESUME times
+func (r *SegmentedReader) fetch(idx int) ([]byte, error) {
+	offset := int64(idx) * r.segSize
+	length := r.segSize
+	if offset+length > r.size {
+		length = r.size - offset
+	}
+	for resumed := 0; ; resumed++ {
+		data, err := r.client.GetBlobRange(r.ctx, r.repo, r.digest, offset, length)
+		if err == nil || resumed >= BLOB_RESUME || r.ctx.Err() != nil {
+			return data, err
+		}
+		log.Warnf("Download segment %v-%v of blob %s failed: %v, resume %v/%v", offset, offset+length-1, r.digest, err, resumed+1, BLOB_RESUME)
+		select {
+		case <-time.After(time.Duration(resumed+1) * time.Second):
+		case <-r.ctx.Done():
+			return nil, r.ctx.Err()
+		}
+	}
+}
+
+func (r *SegmentedReader) Read(p []byte) (int, error) {
+	for {
+		if r.err != nil {
+			return 0, r.err
+		}
+		if r.current != nil && r.current.Len() > 0 {
+			return r.current.Read(p)
+		}
+		if r.current != nil {
+			// the segment is consumed, let the next one start
+			r.current = nil
+			r.next++
+			<-r.window
+		}
+		if r.next == len(r.results) {
+			r.err = io.EOF
+			continue
+		}
+
+		select {
+		case res := <-r.results[r.next]:
+			if res.err != nil {
+				r.err = res.err
+				continue
+			}
+			r.current = bytes.NewReader(res.data)
+		case <-r.ctx.Done():
+			r.err = r.ctx.Err()
+		}
+	}
+}
+
+// Close stops the downloading segments
+func (r *SegmentedReader) Close() error {
+	r.cancel()
+	return nil
+}
@@ -4,17 +4,33 @@ import (
 	"context"
 	"fmt"
 	"io"
+	"strings"
 
+	log "github.com/cihub/seelog"
 	"github.com/containers/image/v5/docker"
+	"github.com/containers/image/v5/docker/reference"
+	"github.com/containers/image/v5/manifest"
 	"github.com/containers/image/v5/types"
+	"github.com/opencontainers/go-digest"
 )
 
 // ImageSource ids a reference to a remote image need to be pulled.
 type ImageSource struct {
-	sourceRef types.ImageReference
-	source    types.ImageSource
 	ctx       context.Context
-	sysctx    *types.SystemContext
+	blobCache types.BlobInfoCache
+	client    *RegistryClient
+	// the manifest of the tag, fetched when the image is opened
+	manifest     []byte
+	manifestType string
+
+	// the registry and its mirrors, the current one serves the image
+	endpoints []*sourceEndpoint
+	current   int
+	// the rate limit of the repo
+	limiter *RateLimiter
+	// the large blobs are downloaded by segments in parallel if set
+	segments    int
+	segmentSize int64
 
 	// source image description
 	registry   string
@@ -22,74 +38,153 @@ type ImageSource struct {
 	tag        string
 }
 
+// sourceEndpoint is the registry or one of its mirrors
+type sourceEndpoint struct {
+	registry string
+	client   *RegistryClient
+}
+
 // NewImageSource generates a PullTask by repository, the repository string must include "tag",
-// if username or password ids empty, access to repository will be anonymous.
-// a repository string ids the rest part of the images url except "tag" and "registry"
-func NewImageSource(pCtx context.Context, registry, repository, tag, username, password string, insecure bool) (*ImageSource, error) {
+// the credentials are resolved by GetCredentials, access to repository will be anonymous if nothing found.
+// a repository string ids the rest part of the images url except "tag" and "registry".
+// The mirrors of the repo are tried in order if the registry is unreachable or the image not found.
+func NewImageSource(pCtx context.Context, registry, repository, tag string, repo *Repo, insecure bool) (*ImageSource, error) {
 	if CheckIfIncludeTag(repository) {
 		return nil, fmt.Errorf("repository string should not include tag")
 	}
 
-	// tag may be empty
-	tagWithColon := ""
-	if tag != "" {
-		tagWithColon = ":" + tag
+	var mirrors []string
+	if repo != nil {
+		mirrors = repo.Mirrors
 	}
 
-	srcRef, err := docker.ParseReference("//" + registry + "/" + repository + tagWithColon)
+	var segments int
+	segmentSize := int64(SEGMENT_SIZE) * 1024 * 1024
+	if repo != nil {
+		segments = repo.Segments
+		if repo.SegmentSize > 0 {
+			segmentSize = int64(repo.SegmentSize) * 1024 * 1024
+		}
+	}
+
+	i := &ImageSource{
+		ctx:         context.WithValue(pCtx, interface{}("ImageSource"), repository),
+		blobCache:   NoCache,
+		limiter:     RepoRateLimiter(repo),
+		segments:    segments,
+		segmentSize: segmentSize,
+		registry:    registry,
+		repository:  repository,
+		tag:         tag,
+	}
+	endpoint, err := newSourceEndpoint(registry, repo, insecure)
 	if err != nil {
 		return nil, err
 	}
-
-	var sysctx *types.SystemContext
-	if insecure {
-		// destinatoin registry ids http service
-		sysctx = &types.SystemContext{
-			DockerInsecureSkipTLSVerify: types.OptionalBoolTrue,
+	i.endpoints = append(i.endpoints, endpoint)
+	for _, m := range mirrors {
+		endpoint, err = newSourceEndpoint(strings.TrimSuffix(strings.TrimPrefix(strings.TrimPrefix(m, "https://"), "http://"), "/"), repo, InsecureTarget(m))
+		if err != nil {
+			return nil, err
 		}
-	} else {
-		sysctx = &types.SystemContext{}
+		i.endpoints = append(i.endpoints, endpoint)
 	}
 
-	ctx := context.WithValue(pCtx, interface{}("ImageSource"), repository)
-	if username != "" && password != "" {
-		sysctx.DockerAuthConfig = &types.DockerAuthConfig{
-			Username: username,
-			Password: password,
+	for idx := range i.endpoints {
+		if err = i.open(idx); err == nil {
+			return i, nil
+		}
+		if !ShouldFallback(err) || idx == len(i.endpoints)-1 {
+			break
 		}
+		log.Warnf("Access %s/%s:%s failed: %v, try the next mirror", i.endpoints[idx].registry, repository, tag, err)
 	}
+	return nil, err
+}
 
-	var rawSource types.ImageSource
-	if tag != "" {
-		// if tag ids empty, will attach to the "latest" tag, and will get a error if "latest" ids not exist
-		rawSource, err = srcRef.NewImageSource(ctx, sysctx)
+func newSourceEndpoint(registry string, repo *Repo, insecure bool) (*sourceEndpoint, error) {
+	username, password, err := GetCredentials(repo, registry)
+	if err != nil {
+		return nil, err
+	}
+
+	insecure = RepoInsecure(repo, insecure)
+	tlsConfig, err := NewTLSConfig(repo, insecure)
+	if err != nil {
+		return nil, err
+	}
+	upstream, err := RepoProxy(repo)
+	if err != nil {
+		return nil, err
+	}
+
+	return &sourceEndpoint{
+		registry: registry,
+		client:   NewRegistryClient(registry, username, password, insecure, tlsConfig, upstream),
+	}, nil
+}
+
+// open the image on an endpoint, the manifest is fetched if the tag is given. The manifests and the blobs are
+// requested by the RegistryClient, so the "Retry-After" of a rate limited registry is honored by the retries
+func (i *ImageSource) open(idx int) error {
+	endpoint := i.endpoints[idx]
+	if i.tag != "" {
+		manifestByte, manifestType, err := endpoint.client.GetManifest(i.ctx, i.repository, i.tag)
 		if err != nil {
-			return nil, err
+			return err
 		}
+		i.manifest = manifestByte
+		i.manifestType = manifestType
 	}
 
-	return &ImageSource{
-		sourceRef:  srcRef,
-		source:     rawSource,
-		ctx:        ctx,
-		sysctx:     sysctx,
-		registry:   registry,
-		repository: repository,
-		tag:        tag,
-	}, nil
+	i.client = endpoint.client
+	i.current = idx
+	return nil
 }
 
 // GetManifest get manifest file from source image
 func (i *ImageSource) GetManifest() ([]byte, string, error) {
-	if i.source == nil {
+	if i.manifest == nil {
+		return nil, "", fmt.Errorf("cannot get manifest file without specfied a tag")
+	}
+	manifestByte, manifestType := i.manifest, i.manifestType
+	if CONF == nil || len(CONF.Platforms) == 0 || !manifest.MIMETypeIsMultiImage(manifestType) {
+		return manifestByte, manifestType, nil
+	}
+	// only the selected platforms will be transmitted, and so does the manifest list
+	manifestByte, pruned, err := FilterManifestList(manifestByte, manifestType, CONF.Platforms)
+	for _, d := range pruned {
+		log.Infof("Skip the manifest %s(%s) of %s/%s:%s, it is not in the platforms %s", ShortenString(d.Digest.String(), 19), d.Platform(), i.registry, i.repository, i.tag, strings.Join(CONF.Platforms, ","))
+	}
+	return manifestByte, manifestType, err
+}
+
+// GetSubManifest get a platform specified manifest of the manifest list from source image, the mirrors are tried
+// in turn from the current endpoint if it fails, as the manifest is verified by the digest
+func (i *ImageSource) GetSubManifest(manifestDigest digest.Digest) ([]byte, string, error) {
+	if i.manifest == nil {
 		return nil, "", fmt.Errorf("cannot get manifest file without specfied a tag")
 	}
-	return i.source.GetManifest(i.ctx, nil)
+	var err error
+	for n := 0; n < len(i.endpoints); n++ {
+		idx := (i.current + n) % len(i.endpoints)
+		var manifestByte []byte
+		var manifestType string
+		manifestByte, manifestType, err = i.endpoints[idx].client.GetManifest(i.ctx, i.repository, manifestDigest.String())
+		if err == nil {
+			return manifestByte, manifestType, nil
+		}
+		if !ShouldFallback(err) || n == len(i.endpoints)-1 {
+			break
+		}
+		log.Warnf("Get manifest %s from %s failed: %v, try %s", manifestDigest, i.endpoints[idx].registry, err, i.endpoints[(idx+1)%len(i.endpoints)].registry)
+	}
+	return nil, "", err
 }
 
 // GetBlobInfos get blobs from source image.
 func (i *ImageSource) GetBlobInfos(manifestByte []byte, manifestType string) ([]types.BlobInfo, error) {
-	if i.source == nil {
+	if i.manifest == nil {
 		return nil, fmt.Errorf("cannot get blobs without specfied a tag")
 	}
 
@@ -115,16 +210,95 @@ func (i *ImageSource) GetBlobInfos(manifestByte []byte, manifestType string) ([]
 	return srcBlobs, nil
 }
 
-// GetABlob gets a blob from remote image
+// GetABlob gets a blob from remote image, the stream is resumed by http range requests if it breaks
+// and the digest is verified at the end, the blob is fetched from the mirrors if the endpoint fails.
+// A large blob is downloaded by segments in parallel from the first endpoint supporting the range request
 func (i *ImageSource) GetABlob(blobInfo types.BlobInfo) (io.ReadCloser, int64, error) {
-	return i.source.GetBlob(i.ctx, types.BlobInfo{Digest: blobInfo.Digest, Size: -1}, NoCache)
+	start := i.current
+	open := func(offset int64) (io.ReadCloser, int64, error) {
+		blob, size, idx, err := i.getBlob(blobInfo.Digest, offset, start)
+		if err == nil {
+			start = idx
+		}
+		return blob, size, err
+	}
+
+	if i.segments > 1 && blobInfo.Size >= 2*i.segmentSize {
+		if idx := i.rangeEndpoint(blobInfo.Digest); idx >= 0 {
+			start = idx
+			log.Debugf("Download blob %s(%v) from %s by %v segments in parallel", blobInfo.Digest, FormatByteSize(blobInfo.Size), i.endpoints[idx].registry, i.segments)
+			segmented := NewSegmentedReader(i.ctx, i.endpoints[idx].client, i.repository, blobInfo.Digest, blobInfo.Size, i.segmentSize, i.segments)
+			return NewResumableReader(i.ctx, segmented, blobInfo.Size, blobInfo.Digest, open), blobInfo.Size, nil
+		}
+	}
+
+	blob, size, err := open(0)
+	if err != nil {
+		return nil, size, err
+	}
+	i.recordLocation(start, blobInfo.Digest)
+	return NewResumableReader(i.ctx, blob, size, blobInfo.Digest, open), size, nil
+}
+
+// getBlob gets the blob from the offset by the endpoints in turn from the start one, the index of the endpoint
+// serving the blob is returned
+func (i *ImageSource) getBlob(d digest.Digest, offset int64, start int) (io.ReadCloser, int64, int, error) {
+	var err error
+	for n := 0; n < len(i.endpoints); n++ {
+		idx := (start + n) % len(i.endpoints)
+		var blob io.ReadCloser
+		var size int64
+		blob, size, err = i.endpoints[idx].client.GetBlob(i.ctx, i.repository, d, offset)
+		if err == nil {
+			return blob, size, idx, nil
+		}
+		if !ShouldFallback(err) || n == len(i.endpoints)-1 {
+			break
+		}
+		log.Warnf("Get blob %s from %s failed: %v, try %s", d, i.endpoints[idx].registry, err, i.endpoints[(idx+1)%len(i.endpoints)].registry)
+	}
+	return nil, -1, start, err
+}
+
+// rangeEndpoint returns the index of the first endpoint from the current one supporting the range request,
+// -1 if none, the blob is then downloaded by a single stream
+func (i *ImageSource) rangeEndpoint(d digest.Digest) int {
+	for n := 0; n < len(i.endpoints); n++ {
+		idx := (i.current + n) % len(i.endpoints)
+		supported, err := SupportsRange(i.ctx, i.endpoints[idx].client, i.repository, d)
+		if err == nil && supported {
+			return idx
+		}
+		if err != nil {
+			log.Warnf("Probe the range request of blob %s on %s failed: %v", d, i.endpoints[idx].registry, err)
+			if !ShouldFallback(err) {
+				return -1
+			}
+		}
+	}
+	return -1
+}
+
+// recordLocation records the repository of the endpoint serving the blob, a destination on the same registry can mount it
+func (i *ImageSource) recordLocation(idx int, d digest.Digest) {
+	named, err := reference.ParseNormalizedNamed(i.endpoints[idx].registry + "/" + i.repository)
+	if err != nil {
+		return
+	}
+	i.blobCache.RecordKnownLocation(docker.Transport, types.BICTransportScope{Opaque: reference.Domain(named)}, d,
+		types.BICLocationReference{Opaque: named.Name()})
+}
+
+// SetBlobCache shares a blob info cache among the tasks of a run, the source locations of the blobs are
+// recorded so that a destination on the same registry can mount them
+func (i *ImageSource) SetBlobCache(cache types.BlobInfoCache) {
+	if cache != nil {
+		i.blobCache = cache
+	}
 }
 
 // Close an ImageSource
 func (i *ImageSource) Close() error {
-	if i.source != nil {
-		return i.source.Close()
-	}
 	return nil
 }
 
@@ -133,6 +307,11 @@ func (i *ImageSource) GetRegistry() string {
 	return i.registry
 }
 
+// GetEndpoint returns the registry or the mirror which serves the ImageSource
+func (i *ImageSource) GetEndpoint() string {
+	return i.endpoints[i.current].registry
+}
+
 // GetRepository returns the repository of a ImageSource
 func (i *ImageSource) GetRepository() string {
 	return i.repository
@@ -143,7 +322,18 @@ func (i *ImageSource) GetTag() string {
 	return i.tag
 }
 
-// GetSourceRepoTags gets all the tags of a repository which ImageSource belongs to
+// GetRateLimiter returns the rate limiter of the repo, may be nil
+func (i *ImageSource) GetRateLimiter() *RateLimiter {
+	return i.limiter
+}
+
+// GetSourceRepoTags gets all the tags of a repository which ImageSource belongs to, the mirrors are tried
+// if the endpoint fails
 func (i *ImageSource) GetSourceRepoTags() ([]string, error) {
-	return docker.GetRepositoryTags(i.ctx, i.sysctx, i.sourceRef)
+	tags, err := i.client.GetTags(i.ctx, i.repository)
+	for idx := i.current + 1; err != nil && ShouldFallback(err) && idx < len(i.endpoints); idx++ {
+		log.Warnf("Get tags of %s/%s failed: %v, try %s", i.endpoints[idx-1].registry, i.repository, err, i.endpoints[idx].registry)
+		tags, err = i.endpoints[idx].client.GetTags(i.ctx, i.repository)
+	}
+	return tags, err
 }
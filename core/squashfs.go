@@ -122,10 +122,21 @@ func (w *SquashfsTar) AppendFileStream(blobName string, size int64, reader io.Re
 			return err
 		}
 	} else {
-		file, _ := os.Create(w.fullPathName(blobName))
-		io.Copy(file, reader)
+		// blobs kept as they are(config, tar and zstd layers) are looked up by the ".raw" suffix in GetFileStream
+		rawName := w.fullPathName(blobName[0:strings.Index(blobName, ".")] + ".raw")
+		file, err := os.Create(rawName)
+		if err != nil {
+			reader.Close()
+			return err
+		}
+		_, err = io.Copy(file, reader)
 		file.Close()
 		reader.Close()
+		// a broken stream or a digest mismatch must not leave a truncated blob in the archive
+		if err != nil {
+			os.Remove(rawName)
+			return err
+		}
 	}
 	return nil
 }
@@ -11,8 +11,9 @@ import (
 )
 
 type LocalTemp struct {
-	files    *list.List
-	tempPath string
+	files     *list.List
+	tempPath  string
+	filesChan chan int
 }
 
 func NewLocalTemp(pathname string) *LocalTemp {
@@ -21,14 +22,17 @@ func NewLocalTemp(pathname string) *LocalTemp {
 		os.MkdirAll(pathname, os.ModePerm)
 	}
 	return &LocalTemp{
-		tempPath: pathname,
-		files:    list.New(),
+		tempPath:  pathname,
+		files:     list.New(),
+		filesChan: make(chan int, 1),
 	}
 }
 
 func (t *LocalTemp) SavePath(path string) (string, error) {
 	fullPathName := filepath.Join(t.tempPath, path)
+	t.filesChan <- 1
 	t.files.PushBack(fullPathName)
+	<-t.filesChan
 	return fullPathName, os.MkdirAll(fullPathName, os.ModePerm)
 }
 
@@ -45,10 +49,42 @@ func (t *LocalTemp) SaveFile(filename string, reader io.ReadCloser, size int64)
 	if err == nil && ws != size {
 		err = fmt.Errorf("file %s content size mismatch, %v VS %v, network or file system problem", filename, ws, size)
 	}
-	if err == nil {
-		t.files.PushBack(fullFilename)
+	if err != nil {
+		// the partial file is not tracked, remove it at once
+		file.Close()
+		os.Remove(fullFilename)
+		return fullFilename, err
+	}
+	t.filesChan <- 1
+	t.files.PushBack(fullFilename)
+	<-t.filesChan
+	return fullFilename, nil
+}
+
+// CreateFile creates a file to write in the temp path, it is removed by Clean if not removed before
+func (t *LocalTemp) CreateFile(filename string) (*os.File, string, error) {
+	fullFilename := filepath.Join(t.tempPath, filename)
+	file, err := os.Create(fullFilename)
+	if err != nil {
+		return nil, fullFilename, err
+	}
+	t.filesChan <- 1
+	t.files.PushBack(fullFilename)
+	<-t.filesChan
+	return file, fullFilename, nil
+}
+
+// Remove deletes a saved file before Clean
+func (t *LocalTemp) Remove(fullFilename string) {
+	t.filesChan <- 1
+	for e := t.files.Front(); e != nil; e = e.Next() {
+		if e.Value.(string) == fullFilename {
+			t.files.Remove(e)
+			break
+		}
 	}
-	return fullFilename, err
+	<-t.filesChan
+	os.Remove(fullFilename)
 }
 
 func (t *LocalTemp) Clean() {
@@ -0,0 +1,147 @@
+package core
+
+import (
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/hex"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+
+	"github.com/containers/image/v5/types"
+)
+
+var (
+	// the staged certificate directories of the repos
+	certDirs     = make(map[string]string)
+	certDirsLock sync.Mutex
+)
+
+// RepoInsecure decides if the TLS of a registry of the repo is skipped, a registry without "https://" is insecure
+// by InsecureTarget, but the one of a repo with its own CA or client certificate is verified over https,
+// unless skiptlsverify is set for the repo or globally
+func RepoInsecure(repo *Repo, insecure bool) bool {
+	if repo == nil {
+		return insecure
+	}
+	if repo.SkipTlsVerify || (CONF != nil && CONF.SkipTlsVerify) {
+		return true
+	}
+	if repo.CACert != "" || repo.ClientCert != "" {
+		return false
+	}
+	return insecure
+}
+
+// NewSystemContext generates the SystemContext of containers/image for a registry of the repo,
+// the CA bundle and the client certificate of the repo are used if configured
+func NewSystemContext(repo *Repo, username string, password string, insecure bool) (*types.SystemContext, error) {
+	var sysctx *types.SystemContext
+	if insecure {
+		// destinatoin registry ids http service
+		sysctx = &types.SystemContext{
+			DockerInsecureSkipTLSVerify: types.OptionalBoolTrue,
+		}
+	} else {
+		sysctx = &types.SystemContext{}
+	}
+
+	if username == IDENTITY_TOKEN_USER {
+		sysctx.DockerAuthConfig = &types.DockerAuthConfig{
+			IdentityToken: password,
+		}
+	} else if username != "" && password != "" {
+		sysctx.DockerAuthConfig = &types.DockerAuthConfig{
+			Username: username,
+			Password: password,
+		}
+	}
+
+	certDir, err := CertDir(repo)
+	if err != nil {
+		return nil, err
+	}
+	sysctx.DockerCertPath = certDir
+	return sysctx, nil
+}
+
+// NewTLSConfig generates the TLS config of the repo for the RegistryClient
+func NewTLSConfig(repo *Repo, insecure bool) (*tls.Config, error) {
+	tlsConfig := &tls.Config{InsecureSkipVerify: insecure}
+	if repo == nil {
+		return tlsConfig, nil
+	}
+
+	if repo.CACert != "" {
+		pool, err := x509.SystemCertPool()
+		if err != nil || pool == nil {
+			pool = x509.NewCertPool()
+		}
+		b, err := ioutil.ReadFile(repo.CACert)
+		if err != nil {
+			return nil, err
+		}
+		if !pool.AppendCertsFromPEM(b) {
+			return nil, fmt.Errorf("no certificate found in %s", repo.CACert)
+		}
+		tlsConfig.RootCAs = pool
+	}
+
+	if repo.ClientCert != "" || repo.ClientKey != "" {
+		cert, err := tls.LoadX509KeyPair(repo.ClientCert, repo.ClientKey)
+		if err != nil {
+			return nil, err
+		}
+		tlsConfig.Certificates = []tls.Certificate{cert}
+	}
+	return tlsConfig, nil
+}
+
+// CertDir stages the CA bundle and the client certificate of the repo into a directory in the layout of
+// docker's certs.d(ca.crt, client.cert and client.key), which is used as the DockerCertPath of containers/image.
+// Empty string is returned if the repo has no certificates.
+func CertDir(repo *Repo) (string, error) {
+	if repo == nil || (repo.CACert == "" && repo.ClientCert == "" && repo.ClientKey == "") {
+		return "", nil
+	}
+	if (repo.ClientCert == "") != (repo.ClientKey == "") {
+		return "", fmt.Errorf("both clientcert and clientkey are required for the client certificate")
+	}
+
+	certDirsLock.Lock()
+	defer certDirsLock.Unlock()
+
+	id := repo.CACert + "|" + repo.ClientCert + "|" + repo.ClientKey
+	if dir, ok := certDirs[id]; ok {
+		return dir, nil
+	}
+
+	sum := sha256.Sum256([]byte(id))
+	dir := filepath.Join(TEMP_DIR, "certs", hex.EncodeToString(sum[:])[:12])
+	os.RemoveAll(dir)
+	if err := os.MkdirAll(dir, os.ModePerm); err != nil {
+		return "", err
+	}
+	files := [][2]string{
+		{repo.CACert, "ca.crt"},
+		{repo.ClientCert, "client.cert"},
+		{repo.ClientKey, "client.key"},
+	}
+	for _, f := range files {
+		if f[0] == "" {
+			continue
+		}
+		b, err := ioutil.ReadFile(f[0])
+		if err != nil {
+			return "", err
+		}
+		if err := ioutil.WriteFile(filepath.Join(dir, f[1]), b, 0600); err != nil {
+			return "", err
+		}
+	}
+	certDirs[id] = dir
+	return dir, nil
+}
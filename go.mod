@@ -7,18 +7,22 @@ require (
 	github.com/cihub/seelog v0.0.0-20170130134532-f561c5e57575
 	github.com/codeclysm/extract/v3 v3.0.2 // indirect
 	github.com/containers/image/v5 v5.12.0
+	github.com/docker/distribution v2.7.1+incompatible
+	github.com/docker/docker-credential-helpers v0.6.3
 	github.com/frankban/quicktest v1.13.0 // indirect
 	github.com/klauspost/compress v1.12.2
 	github.com/lxn/walk v0.0.0-20210112085537-c389da54e794
 	github.com/lxn/win v0.0.0-20210218163916-a377121e959e // indirect
 	github.com/mcuadros/go-version v0.0.0-20190830083331-035f6764e8d2
 	github.com/opencontainers/go-digest v1.0.0
+	github.com/opencontainers/image-spec v1.0.2-0.20190823105129-775207bd45b6
 	github.com/pierrec/lz4 v2.6.1+incompatible
 	github.com/pkg/errors v0.9.1
 	github.com/ulikunitz/xz v0.5.10
 	github.com/vbatts/tar-split v0.11.1
 	github.com/wangyumu/extract/v3 v3.0.3
 	github.com/wangyumu/squashfs v0.4.1-0.20210619005902-780e9a1161fa
+	golang.org/x/crypto v0.0.0-20210322153248-0c34fe9e7dc2
 	golang.org/x/sys v0.0.0-20210514084401-e8d321eab015
 	golang.org/x/text v0.3.4
 	gopkg.in/Knetic/govaluate.v3 v3.0.0 // indirect
@@ -83,6 +83,11 @@ func (mw *MyMainWindow) BeginAction() bool {
 	mw.ctx.Info(I18n.Sprintf("==============BEGIN=============="))
 	mw.ctx.Info(I18n.Sprintf("Transmit params: max threads: %v, max retries: %v", mw.maxConn, retries))
 	mw.ctx.Reset()
+	if CONF.MaxStreams > 0 {
+		mw.ctx.SetMaxStreams(CONF.MaxStreams)
+	} else {
+		mw.ctx.SetMaxStreams(mw.maxConn)
+	}
 	mw.ctx.UpdateSecStart(time.Now().Unix())
 	return true
 }
@@ -175,8 +180,7 @@ func (mw *MyMainWindow) Transmit() {
 				}
 
 				src, dst := GenRepoUrl(mw.srcRepo.Registry, mw.dstRepo.Registry, mw.dstRepo.Repository, rawURL)
-				c.GenerateOnlineTask(src, mw.srcRepo.User, mw.srcRepo.Password,
-					dst, mw.dstRepo.User, mw.dstRepo.Password)
+				c.GenerateOnlineTask(src, mw.srcRepo, dst, mw.dstRepo)
 
 			}
 			mw.ctx.UpdateTotalTask(c.TaskLen())
@@ -225,7 +229,7 @@ func (mw *MyMainWindow) Watch() {
 					srcURL, _ := NewRepoURL(src)
 					dstURL, _ := NewRepoURL(dst)
 
-					imageSourceSrc, err := NewImageSource(mw.ctx.Context, srcURL.GetRegistry(), srcURL.GetRepoWithNamespace(), "", mw.srcRepo.User, mw.srcRepo.Password, InsecureTarget(src))
+					imageSourceSrc, err := NewImageSource(mw.ctx.Context, srcURL.GetRegistry(), srcURL.GetRepoWithNamespace(), "", mw.srcRepo, InsecureTarget(src))
 					if err != nil {
 						log.Error(err)
 						return
@@ -245,14 +249,14 @@ func (mw *MyMainWindow) Watch() {
 							continue
 						}
 
-						newImgSrc, err := NewImageSource(mw.ctx.Context, srcURL.GetRegistry(), srcURL.GetRepoWithNamespace(), tag, mw.srcRepo.User, mw.srcRepo.Password, InsecureTarget(newSrcUrl))
+						newImgSrc, err := NewImageSource(mw.ctx.Context, srcURL.GetRegistry(), srcURL.GetRepoWithNamespace(), tag, mw.srcRepo, InsecureTarget(newSrcUrl))
 						if err != nil {
 							c.PutAInvalidTask(newSrcUrl)
 							mw.ctx.Error(I18n.Sprintf("Url %s format error: %v, skipped", newSrcUrl, err))
 							continue
 						}
 
-						newImgDst, err := NewImageDestination(mw.ctx.Context, dstURL.GetRegistry(), dstURL.GetRepoWithNamespace(), tag, mw.dstRepo.User, mw.dstRepo.Password, InsecureTarget(newDstUrl))
+						newImgDst, err := NewImageDestination(mw.ctx.Context, dstURL.GetRegistry(), dstURL.GetRepoWithNamespace(), tag, mw.dstRepo, InsecureTarget(newDstUrl))
 						if err != nil {
 							c.PutAInvalidTask(newSrcUrl)
 							mw.ctx.Error(I18n.Sprintf("Url %s format error: %v, skipped", newDstUrl, err))
@@ -275,6 +279,8 @@ func (mw *MyMainWindow) Watch() {
 				}
 				mw.ctx.UpdateTotalTask(mw.ctx.GetTotalTask() + c.TaskLen())
 				c.Run()
+				// the destination may be pruned or changed before the next round
+				mw.ctx.Converted = NewConvertedBlobs()
 				select {
 				case <-mw.ctx.Context.Done():
 					mw.ctx.Errorf(I18n.Sprintf("User cancelled..."))
@@ -383,7 +389,7 @@ func (mw *MyMainWindow) Download() {
 				return
 			}
 			src, _ := GenRepoUrl(mw.srcRepo.Registry, mw.dstRepo.Registry, mw.dstRepo.Repository, rawURL)
-			c.GenerateOfflineDownTask(src, mw.srcRepo.User, mw.srcRepo.Password)
+			c.GenerateOfflineDownTask(src, mw.srcRepo)
 		}
 		mw.ctx.UpdateTotalTask(c.TaskLen())
 		c.Run()
@@ -547,7 +553,7 @@ func (mw *MyMainWindow) Upload() {
 				return
 			}
 			src, dst := GenRepoUrl("", mw.dstRepo.Registry, mw.dstRepo.Repository, rawURL)
-			c.GenerateOfflineUploadTask(src, dst, mw.pathUpload, mw.dstRepo.User, mw.dstRepo.Password)
+			c.GenerateOfflineUploadTask(src, dst, mw.pathUpload, mw.dstRepo)
 		}
 
 		mw.ctx.UpdateTotalTask(c.TaskLen())
@@ -57,6 +57,15 @@ func main() {
 	}
 
 	err = yaml.Unmarshal(cfgFile, CONF)
+	if err == nil {
+		err = CONF.DecryptSecrets()
+	}
+	if err == nil {
+		err = CheckProxies(CONF)
+	}
+	if err == nil {
+		err = SetupRateLimit(CONF)
+	}
 
 	if len(CONF.Compressor) == 0 {
 		if runtime.GOOS == "windows" {
@@ -94,6 +103,10 @@ func main() {
 		INTERVAL = CONF.Interval
 	}
 
+	if CONF.BlobRetries > 0 {
+		BLOB_RETRIES = CONF.BlobRetries
+	}
+
 	mw.compressor = CONF.Compressor
 	mw.lmIncrement = NewIncrementListModel()
 